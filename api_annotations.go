@@ -10,6 +10,7 @@ package main
 import (
 	"encoding/json"
 	"github.com/prometheus/common/log"
+	"io"
 	"net/http"
 	"strings"
 )
@@ -24,6 +25,8 @@ type (
 		Datasource string `json:"datasource"`
 		Enable     bool   `json:"enable"`
 		Name       string `json:"name"`
+		// Query is optional tags query expression
+		Query string `json:"query,omitempty"`
 	}
 
 	annotationReq struct {
@@ -36,14 +39,17 @@ type (
 		Annotation annotation `json:"annotation"`
 		Title      string     `json:"title"`
 		// Time in milliseconds
-		Time int64  `json:"time"`
-		Text string `json:"text"`
-		Tags string `json:"tags"`
+		Time int64 `json:"time"`
+		// TimeEnd in milliseconds; only for regions
+		TimeEnd  int64  `json:"timeEnd,omitempty"`
+		IsRegion bool   `json:"isRegion"`
+		Text     string `json:"text"`
+		Tags     string `json:"tags"`
 	}
 
 	// AnnotationHandler for grafana annotations requests
 	AnnotationHandler struct {
-		DB *DB
+		DB EventStore
 	}
 )
 
@@ -69,29 +75,41 @@ func (a *AnnotationHandler) onPost(w http.ResponseWriter, r *http.Request, l log
 		return http.StatusBadRequest, "wrong to date: " + err.Error()
 	}
 
-	name, tags := parseName(ar.Annotation.Name)
-
-	events, err := a.DB.GetEvents(from, to, name)
+	name, tagQuery := parseName(ar.Annotation.Name)
+	tags, err := parseTagQuery(tagQuery, ar.Annotation.Query)
 	if err != nil {
-		l.Errorf("get events (%v, %v, %v) error: %s", from, to, name, err.Error())
-		return http.StatusBadRequest, "error"
+		l.Debugf("wrong tags query: %s", err.Error())
+		return http.StatusBadRequest, "wrong tags query: " + err.Error()
 	}
 
-	resp := make([]annotationResp, 0, len(events))
-	for _, e := range events {
-		if !e.CheckTags(tags) {
-			continue
-		}
-		resp = append(resp, annotationResp{
-			Annotation: ar.Annotation,
-			Title:      e.Title,
-			Time:       e.Time / 1000000,
-			Text:       e.Text,
-			Tags:       strings.Join(e.Tags, " "),
-		})
+	q := Query{From: from, To: to, Name: name, Tags: tags}
+	if err := q.Validate(); err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, "wrong query: " + err.Error()
 	}
 
-	return http.StatusOK, resp
+	ctx := r.Context()
+	return http.StatusOK, responseStreamer(func(w io.Writer) error {
+		aw := newJSONArrayWriter(w)
+		_, err := a.DB.IterEvents(ctx, q, func(e *Event) error {
+			ann := annotationResp{
+				Annotation: ar.Annotation,
+				Title:      e.Title,
+				Time:       e.Time / 1000000,
+				Text:       e.Text,
+				Tags:       strings.Join(e.Tags, " "),
+			}
+			if e.IsRegion() {
+				ann.IsRegion = true
+				ann.TimeEnd = e.TimeEnd / 1000000
+			}
+			return aw.Write(ann)
+		})
+		if err != nil {
+			return err
+		}
+		return aw.Close()
+	})
 }
 
 func (a *AnnotationHandler) onOptions(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
@@ -116,10 +134,5 @@ func (a AnnotationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Methods", "POST")
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(code)
-
-	if data != nil {
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			l.Errorf("encoding error: %s", err)
-		}
-	}
+	writeResponse(w, data, l)
 }
@@ -0,0 +1,217 @@
+//
+// api_bulk.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode"
+
+	"github.com/prometheus/common/log"
+)
+
+// bulkBatchSize is max number of events saved in one transaction
+const bulkBatchSize = 1000
+
+// bulkMaxLineSize is max size of one line in NDJSON stream
+const bulkMaxLineSize = 1024 * 1024
+
+// Status of items in bulk request
+const (
+	bulkAccepted = "accepted"
+	bulkRejected = "rejected"
+)
+
+type (
+	// bulkEventsHandler accept many events in one request as JSON array or
+	// NDJSON stream
+	bulkEventsHandler struct {
+		Configuration *Configuration
+		DB            EventStore
+	}
+
+	bulkItemResult struct {
+		// Index of item in request (from 0)
+		Index  int
+		ID     string `json:",omitempty"`
+		Status string
+		Reason string `json:",omitempty"`
+	}
+
+	bulkResp struct {
+		Accepted int
+		Rejected int
+		// Error when request can't be read to end
+		Error string `json:",omitempty"`
+		Items []*bulkItemResult
+	}
+
+	bulkWriter struct {
+		db    EventStore
+		c     *Configuration
+		l     log.Logger
+		resp  *bulkResp
+		batch []*Event
+		items []*bulkItemResult
+	}
+)
+
+func (b *bulkWriter) reject(res *bulkItemResult, reason string) {
+	res.Status = bulkRejected
+	res.Reason = reason
+	b.resp.Rejected++
+}
+
+func (b *bulkWriter) accept(res *bulkItemResult, e *Event) {
+	res.Status = bulkAccepted
+	res.ID = e.ID
+	b.resp.Accepted++
+}
+
+// add decode and validate item; valid events are saved in batches
+func (b *bulkWriter) add(data []byte) {
+	res := &bulkItemResult{Index: len(b.resp.Items)}
+	b.resp.Items = append(b.resp.Items, res)
+
+	ev := &eventReq{}
+	if err := json.Unmarshal(data, ev); err != nil {
+		b.reject(res, "bad request: "+err.Error())
+		return
+	}
+
+	event, _, err := ev.toEvent(b.c)
+	if err != nil {
+		b.reject(res, err.Error())
+		return
+	}
+
+	b.batch = append(b.batch, event)
+	b.items = append(b.items, res)
+	if len(b.batch) >= bulkBatchSize {
+		b.flush()
+	}
+}
+
+// flush save pending events
+func (b *bulkWriter) flush() {
+	if len(b.batch) == 0 {
+		return
+	}
+
+	if err := b.db.SaveEvents(b.batch); err != nil {
+		// batch is saved atomically, so find failing events by saving one
+		// by one
+		b.l.Errorf("save events error: %s; saving events separately", err.Error())
+		for i, res := range b.items {
+			if err := b.db.SaveEvent(b.batch[i]); err != nil {
+				eventAddError.Inc()
+				b.reject(res, err.Error())
+			} else {
+				eventsAdded.WithLabelValues("api-v1-events-bulk").Inc()
+				b.accept(res, b.batch[i])
+			}
+		}
+	} else {
+		eventsAdded.WithLabelValues("api-v1-events-bulk").Add(float64(len(b.batch)))
+		for i, res := range b.items {
+			b.accept(res, b.batch[i])
+		}
+	}
+
+	b.batch = b.batch[:0]
+	b.items = b.items[:0]
+}
+
+// readJSONArray read items from JSON array
+func (b *bulkWriter) readJSONArray(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		b.add(item)
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// readNDJSON read items from stream of JSON objects, one per line
+func (b *bulkWriter) readNDJSON(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), bulkMaxLineSize)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) > 0 {
+			b.add(line)
+		}
+	}
+	return s.Err()
+}
+
+func (h *bulkEventsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "bulkEventsHandler.onPost")
+
+	b := &bulkWriter{
+		db:   h.DB,
+		c:    h.Configuration,
+		l:    l,
+		resp: &bulkResp{Items: []*bulkItemResult{}},
+	}
+
+	br := bufio.NewReader(r.Body)
+	var err error
+	for {
+		var c rune
+		if c, _, err = br.ReadRune(); err != nil {
+			break
+		}
+		if unicode.IsSpace(c) {
+			continue
+		}
+		br.UnreadRune()
+		if c == '[' {
+			err = b.readJSONArray(br)
+		} else {
+			err = b.readNDJSON(br)
+		}
+		break
+	}
+	b.flush()
+
+	if err != nil && err != io.EOF {
+		l.Debugf("read request error: %s", err)
+		b.resp.Error = fmt.Sprintf("read request error after %d items: %s", len(b.resp.Items), err)
+		return http.StatusBadRequest, b.resp
+	}
+
+	return http.StatusOK, b.resp
+}
+
+func (h bulkEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch r.Method {
+	case "POST":
+		code, data = h.onPost(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
@@ -0,0 +1,129 @@
+//
+// api_bulk_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkEvents(t *testing.T) {
+	db := NewMemStore()
+
+	retention := 24 * time.Hour
+	h := bulkEventsHandler{Configuration: &Configuration{RetentionParsed: &retention}, DB: db}
+	now := time.Now().Unix()
+
+	post := func(body string) (int, *bulkResp) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/events/bulk", strings.NewReader(body)))
+		res := &bulkResp{}
+		if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+			t.Fatalf("decode response error: %s", err)
+		}
+		return w.Code, res
+	}
+
+	statuses := func(res *bulkResp) string {
+		var s []string
+		for _, item := range res.Items {
+			s = append(s, item.Status+":"+item.Reason)
+		}
+		return strings.Join(s, ",")
+	}
+
+	code, res := post(fmt.Sprintf(` [
+		{"name": "b1", "title": "e1", "time": %d},
+		{"name": "b2", "title": "e2", "time": %d, "tags": "t1 t2"},
+		{"name": "b1", "title": "old", "time": %d},
+		{"name": "b1", "title": "bad", "time": "x"},
+		{"name": "b1", "title": "bad", "time": 1, "tags": []}
+	]`, now, now+1, now-2*24*3600))
+	if code != http.StatusOK || res.Accepted != 2 || res.Rejected != 3 {
+		t.Fatalf("invalid response for array: %d %+v", code, res)
+	}
+	if s := statuses(res); !strings.HasPrefix(s, "accepted:,accepted:,rejected:not inserted due retention time,rejected:wrong time,rejected:bad request") {
+		t.Errorf("invalid items statuses: %s", s)
+	}
+
+	var lines []string
+	for i := 0; i < bulkBatchSize+10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"name": "b3", "title": "n%d", "time": %d}`, i, now+int64(i)))
+	}
+	lines = append(lines, "", "{broken")
+	code, res = post(strings.Join(lines, "\n"))
+	if code != http.StatusOK || res.Accepted != bulkBatchSize+10 || res.Rejected != 1 {
+		t.Fatalf("invalid response for ndjson: %d %d %d", code, res.Accepted, res.Rejected)
+	}
+
+	events, _, err := db.GetEvents(Query{From: time.Unix(now-3600, 0), To: time.Unix(now+3600, 0), Name: AnyBucket})
+	if err != nil || len(events) != bulkBatchSize+12 {
+		t.Fatalf("invalid events in db: %d, %v", len(events), err)
+	}
+	if id := res.Items[5].ID; id == "" {
+		t.Errorf("missing id for accepted event")
+	} else if e, err := db.GetEvent(id); err != nil || e.Title != "n5" {
+		t.Errorf("invalid event for id %s: %+v, %v", id, e, err)
+	}
+
+	code, res = post(`[{"name": "b1", "title": "e1", "time": 1}, {"name":`)
+	if code != http.StatusBadRequest || res.Error == "" || len(res.Items) != 1 {
+		t.Errorf("invalid response for broken array: %d %+v", code, res)
+	}
+}
+
+// failingStore reject events titled "fail"
+type failingStore struct {
+	*MemStore
+}
+
+func (f failingStore) SaveEvent(e *Event) error {
+	if e.Title == "fail" {
+		return fmt.Errorf("save failed")
+	}
+	return f.MemStore.SaveEvent(e)
+}
+
+func (f failingStore) SaveEvents(events []*Event) error {
+	for _, e := range events {
+		if e.Title == "fail" {
+			return fmt.Errorf("save failed")
+		}
+	}
+	return f.MemStore.SaveEvents(events)
+}
+
+func TestBulkEventsBatchError(t *testing.T) {
+	db := NewMemStore()
+	h := bulkEventsHandler{Configuration: &Configuration{}, DB: failingStore{db}}
+	now := time.Now().Unix()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/events/bulk", strings.NewReader(fmt.Sprintf(`[
+		{"name": "b1", "title": "ok", "time": %d},
+		{"name": "b1", "title": "fail", "time": %d}
+	]`, now, now))))
+	res := &bulkResp{}
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatalf("decode response error: %s", err)
+	}
+	if w.Code != http.StatusOK || res.Accepted != 1 || res.Rejected != 1 || len(res.Items) != 2 {
+		t.Fatalf("invalid response: %d %+v", w.Code, res)
+	}
+	if item := res.Items[1]; item.Status != bulkRejected || item.Reason != "save failed" {
+		t.Errorf("invalid status for failed event: %+v", item)
+	}
+	if e, err := db.GetEvent(res.Items[0].ID); err != nil || e.Title != "ok" {
+		t.Errorf("invalid event for id %s: %+v, %v", res.Items[0].ID, e, err)
+	}
+}
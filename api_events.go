@@ -8,9 +8,14 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,6 +30,13 @@ var (
 		},
 		[]string{"src"},
 	)
+	eventsUpdated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eventdb_events_updated_total",
+			Help: "Total number events updated",
+		},
+		[]string{"src"},
+	)
 	eventAddError = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "eventdb_events_failed_total",
@@ -35,68 +47,110 @@ var (
 
 func init() {
 	prometheus.MustRegister(eventsAdded)
+	prometheus.MustRegister(eventsUpdated)
 	prometheus.MustRegister(eventAddError)
 }
 
 type (
 	eventsHandler struct {
 		Configuration *Configuration
-		DB            *DB
+		DB            EventStore
 	}
 
 	eventReq struct {
-		Name  string
-		Title string
-		Time  interface{}
-		Text  string
-		Tags  string
+		Name         string
+		Title        string
+		Time         interface{}
+		TimeEnd      interface{}
+		Text         string
+		Tags         string
+		DashboardUID string
+		PanelID      int64
 	}
 )
 
-func (e *eventsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
-	l = l.With("action", "eventsHandler.onPost")
-
-	ev := &eventReq{}
-	if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
-		l.Debugf("body decode error: %s", err)
-		return 442, "bad request"
+// parseReqTime convert time from request (number or RFC3339 string) to
+// unix nanoseconds
+func parseReqTime(v interface{}) (int64, error) {
+	switch v.(type) {
+	case int64:
+		return numToUnixNano(v.(int64)), nil
+	case float64:
+		return numToUnixNano(int64(v.(float64))), nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v.(string))
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	case nil:
+		return 0, nil
 	}
+	return 0, fmt.Errorf("unsupported time format")
+}
 
+// errRetention when event is older than configured retention time
+var errRetention = errors.New("not inserted due retention time")
+
+// toEvent validate request and create event from it; on error return also
+// http status for response
+func (ev *eventReq) toEvent(c *Configuration) (*Event, int, error) {
 	event := &Event{
-		Name:  ev.Name,
-		Title: ev.Title,
-		Text:  ev.Text,
+		Name:         ev.Name,
+		Title:        ev.Title,
+		Text:         ev.Text,
+		DashboardUID: ev.DashboardUID,
+		PanelID:      ev.PanelID,
+	}
+
+	if !isEventBucket(eventBucketName(ev.Name)) {
+		return nil, http.StatusBadRequest, fmt.Errorf("wrong name")
 	}
 
 	if ev.Tags != "" {
 		event.SetTags(ev.Tags)
 	}
 
-	switch ev.Time.(type) {
-	case int64:
-		event.Time = numToUnixNano(ev.Time.(int64))
-	case float64:
-		event.Time = numToUnixNano(int64(ev.Time.(float64)))
-	case string:
-		if t, err := time.Parse(time.RFC3339Nano, ev.Time.(string)); err == nil {
-			event.Time = t.UnixNano()
-		} else {
-			l.Debugf("parsing time %+v error %s", ev.Time, err)
-			return http.StatusBadRequest, "wrong time"
-		}
+	if ts, err := parseReqTime(ev.Time); err == nil {
+		event.Time = ts
+	} else {
+		return nil, http.StatusBadRequest, fmt.Errorf("wrong time")
 	}
 
 	if event.Time == 0 {
-		l.Debugf("wrong time %+v", ev.Time)
-		return http.StatusBadRequest, "wrong time"
+		return nil, http.StatusBadRequest, fmt.Errorf("wrong time")
 	}
 
-	if e.Configuration.RetentionParsed != nil {
-		minDate := time.Now().Add(-(*e.Configuration.RetentionParsed)).UnixNano()
-		if minDate > event.Time {
-			log.Debugf("date %s before retention time - skipping", ev.Time)
-			return http.StatusNotModified, "not inserted due retention time"
-		}
+	if ts, err := parseReqTime(ev.TimeEnd); err == nil {
+		event.TimeEnd = ts
+	} else {
+		return nil, http.StatusBadRequest, fmt.Errorf("wrong time end")
+	}
+
+	if event.TimeEnd != 0 && event.TimeEnd < event.Time {
+		return nil, http.StatusBadRequest, fmt.Errorf("time end before time")
+	}
+
+	if !c.checkRetention(event, time.Now()) {
+		return nil, http.StatusNotModified, errRetention
+	}
+
+	return event, 0, nil
+}
+
+func (e *eventsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "eventsHandler.onPost")
+
+	ev := &eventReq{}
+	if err := json.NewDecoder(r.Body).Decode(ev); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return 442, "bad request"
+	}
+
+	event, code, err := ev.toEvent(e.Configuration)
+	if err != nil {
+		l.Debugf("invalid event %+v: %s", ev, err)
+		return code, err.Error()
 	}
 
 	if err := e.DB.SaveEvent(event); err != nil {
@@ -106,20 +160,34 @@ func (e *eventsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Log
 	}
 
 	eventsAdded.WithLabelValues("api-v1-event-post").Inc()
-	return http.StatusCreated, "ok"
+	res := &struct {
+		ID string
+	}{
+		ID: event.ID,
+	}
+	return http.StatusCreated, res
 }
 
 type eventsOnGetRespHeader struct {
 	From time.Time
 	To   time.Time
 	Name string
+	// Tags required by query; nil when query is not plain list of tags
 	Tags []string
+	// TagsQuery is tags expression
+	TagsQuery string `json:",omitempty"`
+	Query     string
+	// DashboardUID and PanelID filters
+	DashboardUID string `json:",omitempty"`
+	PanelID      int64  `json:",omitempty"`
+	Order        string `json:",omitempty"`
+	Limit        int    `json:",omitempty"`
+	// Next is cursor for next page of events
+	Next string `json:",omitempty"`
 }
 
-type eventsOnGetResp struct {
-	Header *eventsOnGetRespHeader
-	Events []*Event
-}
+// eventsCSVHeader is header of events list in CSV format
+var eventsCSVHeader = []string{"time", "name", "title", "text", "tags"}
 
 func (e *eventsHandler) onGet(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
 	l = l.With("action", "eventsHandler.onGet")
@@ -127,51 +195,122 @@ func (e *eventsHandler) onGet(w http.ResponseWriter, r *http.Request, l log.Logg
 	r.ParseForm()
 	vars := r.Form
 
-	to := time.Now()
-	from := to.AddDate(0, 0, -1)
+	from, to, err := parseTimeRange(vars, 24*time.Hour)
+	if err != nil {
+		l.Debugf("wrong time range: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+
+	name, tagQuery := parseName(vars.Get("name"))
+	tags, err := parseTagQuery(tagQuery, vars.Get("tags"))
+	if err != nil {
+		l.Debugf("wrong tags query: %s", err.Error())
+		return http.StatusBadRequest, "wrong tags query: " + err.Error()
+	}
+
+	q := Query{
+		From:         from,
+		To:           to,
+		Name:         name,
+		Tags:         tags,
+		Text:         vars.Get("q"),
+		DashboardUID: vars.Get("dashboardUID"),
+		Order:        vars.Get("order"),
+		Cursor:       vars.Get("cursor"),
+	}
 
-	if vfrom := vars.Get("from"); vfrom != "" {
-		if fts, err := parseTime(vfrom); err == nil {
-			from = fts
+	if vpanel := vars.Get("panelId"); vpanel != "" {
+		if panel, err := strconv.ParseInt(vpanel, 10, 64); err == nil {
+			q.PanelID = panel
 		} else {
-			l.Debugf("wrong from date: %s", err.Error())
-			return http.StatusBadRequest, "wrong from date"
+			l.Debugf("wrong panel id: %s", vpanel)
+			return http.StatusBadRequest, "wrong panel id"
 		}
 	}
-	if vto := vars.Get("to"); vto != "" {
-		if tts, err := parseTime(vto); err == nil {
-			to = tts
+
+	if vlimit := vars.Get("limit"); vlimit != "" {
+		if limit, err := strconv.Atoi(vlimit); err == nil && limit >= 0 {
+			q.Limit = limit
 		} else {
-			l.Debugf("wrong to date: %s", err.Error())
-			return http.StatusBadRequest, "wrong to date"
+			l.Debugf("wrong limit: %s", vlimit)
+			return http.StatusBadRequest, "wrong limit"
 		}
 	}
 
-	name, tags := parseName(vars.Get("name"))
+	if err := q.Validate(); err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
 
-	events, _ := e.DB.GetEvents(from, to, name)
-	if tags == nil || len(tags) == 0 {
-		return http.StatusOK, events
+	ctx := r.Context()
+
+	if vars.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		return http.StatusOK, csvStreamer(func(w *csv.Writer) error {
+			if err := w.Write(eventsCSVHeader); err != nil {
+				return err
+			}
+			_, err := e.DB.IterEvents(ctx, q, func(e *Event) error {
+				return w.Write([]string{
+					time.Unix(0, e.Time).UTC().Format(time.RFC3339),
+					e.Name,
+					e.Title,
+					e.Text,
+					strings.Join(e.Tags, " "),
+				})
+			})
+			return err
+		})
 	}
 
-	filteredEvents := make([]*Event, 0, len(events))
-	for _, e := range events {
-		if e.CheckTags(tags) {
-			filteredEvents = append(filteredEvents, e)
-		}
+	if tags == nil && q.Text == "" && q.DashboardUID == "" && q.PanelID == 0 &&
+		q.Limit == 0 && q.Cursor == "" && q.Order == "" {
+		return http.StatusOK, responseStreamer(func(w io.Writer) error {
+			return streamEvents(w, func(fn func(*Event) error) error {
+				_, err := e.DB.IterEvents(ctx, q, fn)
+				return err
+			})
+		})
 	}
 
-	response := &eventsOnGetResp{
-		Header: &eventsOnGetRespHeader{
-			From: from,
-			To:   to,
-			Name: name,
-			Tags: tags,
-		},
-		Events: filteredEvents,
+	header := &eventsOnGetRespHeader{
+		From:  from,
+		To:    to,
+		Name:  name,
+		Query: q.Text,
+		Order: q.Order,
+		Limit: q.Limit,
+
+		DashboardUID: q.DashboardUID,
+		PanelID:      q.PanelID,
+	}
+	if tags != nil {
+		header.Tags = requiredTags(tags)
+		header.TagsQuery = tags.String()
 	}
 
-	return http.StatusOK, response
+	// cursor for next page is known after all events are written, so
+	// events are written before header
+	return http.StatusOK, responseStreamer(func(w io.Writer) error {
+		if _, err := io.WriteString(w, `{"Events":`); err != nil {
+			return err
+		}
+		err := streamEvents(w, func(fn func(*Event) error) error {
+			next, err := e.DB.IterEvents(ctx, q, fn)
+			header.Next = next
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `,"Header":`); err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(header); err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "}\n")
+		return err
+	})
 }
 
 func (e *eventsHandler) onDelete(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
@@ -182,13 +321,19 @@ func (e *eventsHandler) onDelete(w http.ResponseWriter, r *http.Request, l log.L
 
 	var from, to time.Time
 
-	if fts, err := parseTime(vars.Get("from")); err == nil {
+	now, err := requestNow(vars.Get("tz"))
+	if err != nil {
+		l.Debugf("wrong time zone: %s", err.Error())
+		return http.StatusBadRequest, "wrong time zone"
+	}
+
+	if fts, err := parseTimeIn(vars.Get("from"), now); err == nil {
 		from = fts
 	} else {
 		l.Debugf("wrong from date: %s", err.Error())
 		return http.StatusBadRequest, "wrong 'from' date"
 	}
-	if tts, err := parseTime(vars.Get("to")); err == nil {
+	if tts, err := parseTimeIn(vars.Get("to"), now); err == nil {
 		to = tts
 	} else {
 		l.Debugf("wrong to date: %s", err.Error())
@@ -228,18 +373,119 @@ func (e eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		code, data = e.onDelete(w, r, l)
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if _, ok := data.(csvStreamer); ok {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	}
 	w.WriteHeader(code)
-	if data != nil {
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			l.Errorf("encoding result error: %s", err)
+	writeResponse(w, data, l)
+}
+
+type (
+	eventByIDHandler struct {
+		DB EventStore
+	}
+
+	eventPatchReq struct {
+		Title *string
+		Text  *string
+		Tags  *string
+	}
+)
+
+func (e *eventByIDHandler) onGet(w http.ResponseWriter, r *http.Request, l log.Logger, id string) (int, interface{}) {
+	l = l.With("action", "eventByIDHandler.onGet")
+
+	event, err := e.DB.GetEvent(id)
+	if err == ErrEventNotFound {
+		return http.StatusNotFound, "not found"
+	} else if err != nil {
+		l.Errorf("get event %s error: %s", id, err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+
+	return http.StatusOK, event
+}
+
+func (e *eventByIDHandler) onPatch(w http.ResponseWriter, r *http.Request, l log.Logger, id string) (int, interface{}) {
+	l = l.With("action", "eventByIDHandler.onPatch")
+
+	req := &eventPatchReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return 442, "bad request"
+	}
+
+	event, err := e.DB.UpdateEvent(id, func(ev *Event) error {
+		if req.Title != nil {
+			ev.Title = *req.Title
+		}
+		if req.Text != nil {
+			ev.Text = *req.Text
+		}
+		if req.Tags != nil {
+			ev.SetTags(*req.Tags)
+		}
+		return nil
+	})
+	if err == ErrEventNotFound {
+		return http.StatusNotFound, "not found"
+	} else if err != nil {
+		l.Errorf("update event %s error: %s", id, err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+
+	eventsUpdated.WithLabelValues("api-v1-event-patch").Inc()
+	return http.StatusOK, event
+}
+
+func (e *eventByIDHandler) onDelete(w http.ResponseWriter, r *http.Request, l log.Logger, id string) (int, interface{}) {
+	l = l.With("action", "eventByIDHandler.onDelete")
+
+	err := e.DB.DeleteEvent(id)
+	if err == ErrEventNotFound {
+		return http.StatusNotFound, "not found"
+	} else if err != nil {
+		l.Errorf("delete event %s error: %s", id, err.Error())
+		return http.StatusInternalServerError, "delete error"
+	}
+
+	res := &struct {
+		Deleted int
+	}{
+		Deleted: 1,
+	}
+	return http.StatusOK, res
+}
+
+// ServeHTTP handle request for single event; path should contain only event id
+func (e eventByIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	id := strings.Trim(r.URL.Path, "/")
+	if id != "" && !strings.Contains(id, "/") {
+		switch r.Method {
+		case "GET":
+			code, data = e.onGet(w, r, l, id)
+		case "PATCH":
+			code, data = e.onPatch(w, r, l, id)
+		case "DELETE":
+			code, data = e.onDelete(w, r, l, id)
 		}
 	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
 }
 
 type humanEventsHandler struct {
 	Configuration *Configuration
-	DB            *DB
+	DB            EventStore
 }
 
 func (h humanEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -250,32 +496,42 @@ func (h humanEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	vars := r.Form
 
-	to := time.Now()
-	from := to.Add(time.Duration(-2) * time.Hour)
+	from, to, err := parseTimeRange(vars, 2*time.Hour)
+	if err != nil {
+		l.Debugf("wrong time range: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	name, tags := parseName(vars.Get("name"))
+	name, tagQuery := parseName(vars.Get("name"))
 	if name == "" {
 		name = "_any_"
 	}
 
-	events, err := h.DB.GetEvents(from, to, name)
+	tags, err := parseTagQuery(tagQuery, vars.Get("tags"))
 	if err != nil {
-		l.Errorf("get events error: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		l.Debugf("wrong tags query: %s", err.Error())
+		http.Error(w, "wrong tags query: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("Events for %s from %s to %s\n\n", name, from, to)))
 
-	for i, e := range events {
-		if !e.CheckTags(tags) {
-			continue
+	i := 0
+	q := Query{From: from, To: to, Name: name, Tags: tags, Text: vars.Get("q")}
+	_, err = h.DB.IterEvents(r.Context(), q, func(e *Event) error {
+		i++
+		ts := time.Unix(0, e.Time).String()
+		if e.IsRegion() {
+			ts += " - " + time.Unix(0, e.TimeEnd).String()
 		}
-		ts := time.Unix(0, e.Time)
-		w.Write([]byte(fmt.Sprintf("%d. %s   Name: %v\nTitle: %s\nText: %s\nTags: %s\n",
-			(i + 1), ts, e.Name, e.Title, e.Text, e.Tags)))
-		w.Write([]byte{'\n', '\n'})
+		_, err := w.Write([]byte(fmt.Sprintf("%d. %s   Name: %v   ID: %s\nTitle: %s\nText: %s\nTags: %s\n\n\n",
+			i, ts, e.Name, e.ID, e.Title, e.Text, e.Tags)))
+		return err
+	})
+	if err != nil {
+		l.Errorf("get events error: %s", err.Error())
 	}
 }
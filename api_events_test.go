@@ -0,0 +1,108 @@
+//
+// api_events_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsCSV(t *testing.T) {
+	db := NewMemStore()
+
+	base := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{Name: "alerts", Title: "alert, firing", Time: base.UnixNano(),
+			Text: "summary: \"disk full\"\ninstance: host1\n", Tags: []string{"t1", "t2"}},
+		{Name: "deploy", Title: "deploy", Time: base.Add(time.Minute).UnixNano()},
+	}
+	for _, e := range events {
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	h := eventsHandler{Configuration: &Configuration{}, DB: db}
+	expected := [][]string{
+		{"time", "name", "title", "text", "tags"},
+		{"2017-01-01T12:00:00Z", "alerts", "alert, firing", "summary: \"disk full\"\ninstance: host1\n", "t1 t2"},
+		{"2017-01-01T12:01:00Z", "deploy", "deploy", "", ""},
+	}
+
+	for _, tt := range []struct {
+		query  string
+		accept string
+	}{
+		{"format=csv", ""},
+		{"", "text/csv"},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/event?name=_any_&from=2017-01-01&to=2017-01-02&"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+			t.Fatalf("invalid response for %+v: %d %s", tt, w.Code, w.Header().Get("Content-Type"))
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("read csv error: %s", err)
+		}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("invalid csv for %+v: %q", tt, records)
+		}
+	}
+}
+
+func TestEventsTagsHeader(t *testing.T) {
+	db := NewMemStore()
+	base := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := db.SaveEvent(&Event{Name: "alerts", Title: "a1", Time: base.UnixNano(),
+		Tags: []string{"t1", "t2"}}); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+
+	h := eventsHandler{Configuration: &Configuration{}, DB: db}
+	for _, tt := range []struct {
+		query     string
+		tags      []string
+		tagsQuery string
+	}{
+		{"name=alerts:t1:t2", []string{"t1", "t2"}, "t1 AND t2"},
+		{"name=alerts&tags=t1+OR+t3", nil, "t1 OR t3"},
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/event?from=2017-01-01&to=2017-01-02&"+tt.query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		var res struct {
+			Header struct {
+				Tags      []string
+				TagsQuery string
+			}
+			Events []*Event
+		}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("decode response for %q error: %s", tt.query, err)
+		}
+		if !reflect.DeepEqual(res.Header.Tags, tt.tags) || res.Header.TagsQuery != tt.tagsQuery {
+			t.Errorf("invalid header for %q: %+v", tt.query, res.Header)
+		}
+		if len(res.Events) != 1 {
+			t.Errorf("invalid events for %q: %+v", tt.query, res.Events)
+		}
+	}
+}
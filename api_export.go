@@ -0,0 +1,104 @@
+//
+// api_export.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/common/log"
+)
+
+type (
+	// exportHandler export and import events as JSON Lines
+	exportHandler struct {
+		DB EventStore
+	}
+
+	importResp struct {
+		Imported int
+		Skipped  int
+		Error    string `json:",omitempty"`
+	}
+)
+
+func (h *exportHandler) query(r *http.Request) (Query, error) {
+	r.ParseForm()
+	vars := r.Form
+	return exportQuery(vars.Get("from"), vars.Get("to"), vars.Get("name"), vars.Get("tags"))
+}
+
+func (h *exportHandler) onExport(w http.ResponseWriter, r *http.Request, l log.Logger) {
+	l = l.With("action", "exportHandler.onExport")
+
+	q, err := h.query(r)
+	if err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="events.jsonl"`)
+	w.WriteHeader(http.StatusOK)
+
+	dw := newDeadlineWriter(w)
+	exported, err := h.DB.ExportEvents(r.Context(), dw, q)
+	if cerr := dw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		l.Errorf("export error after %d events: %s", exported, err)
+		return
+	}
+	l.Infof("exported %d events", exported)
+}
+
+func (h *exportHandler) onImport(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "exportHandler.onImport")
+
+	q, err := h.query(r)
+	if err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+
+	imported, skipped, err := h.DB.ImportEvents(r.Body, q)
+	res := &importResp{
+		Imported: imported,
+		Skipped:  skipped,
+	}
+	if err != nil {
+		l.Infof("import error: %s", err.Error())
+		res.Error = err.Error()
+		return http.StatusBadRequest, res
+	}
+
+	l.Infof("imported %d events, skipped %d", imported, skipped)
+	eventsAdded.WithLabelValues("api-v1-events-import").Add(float64(imported))
+	return http.StatusOK, res
+}
+
+// ServeHTTP handle /export (GET) and /import (POST) requests
+func (h exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch {
+	case r.URL.Path == "/export" && r.Method == "GET":
+		h.onExport(w, r, l)
+		return
+	case r.URL.Path == "/import" && r.Method == "POST":
+		code, data = h.onImport(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
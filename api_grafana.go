@@ -0,0 +1,267 @@
+//
+// api_grafana.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// grafanaAnnotationsPath is prefix of Grafana-compatible annotations api
+const grafanaAnnotationsPath = "/api/annotations"
+
+type (
+	// grafanaAnnotation is annotation in Grafana http api format
+	grafanaAnnotation struct {
+		ID           string   `json:"id"`
+		DashboardUID string   `json:"dashboardUID"`
+		PanelID      int64    `json:"panelId"`
+		Time         int64    `json:"time"`
+		TimeEnd      int64    `json:"timeEnd"`
+		Text         string   `json:"text"`
+		Tags         []string `json:"tags"`
+	}
+
+	grafanaAnnotationReq struct {
+		DashboardUID string   `json:"dashboardUID"`
+		PanelID      int64    `json:"panelId"`
+		Time         int64    `json:"time"`
+		TimeEnd      int64    `json:"timeEnd"`
+		Text         string   `json:"text"`
+		Tags         []string `json:"tags"`
+	}
+
+	grafanaAnnotationPatchReq struct {
+		Time    *int64    `json:"time"`
+		TimeEnd *int64    `json:"timeEnd"`
+		Text    *string   `json:"text"`
+		Tags    *[]string `json:"tags"`
+	}
+
+	grafanaMessage struct {
+		Message string `json:"message"`
+		ID      string `json:"id,omitempty"`
+	}
+
+	// GrafanaAnnotationsHandler implement subset of Grafana annotations http
+	// api (/api/annotations); annotations are created in default bucket and
+	// listed from all buckets
+	GrafanaAnnotationsHandler struct {
+		Configuration *Configuration
+		DB            EventStore
+	}
+)
+
+func newGrafanaAnnotation(e *Event) *grafanaAnnotation {
+	tags := e.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return &grafanaAnnotation{
+		ID:           e.ID,
+		DashboardUID: e.DashboardUID,
+		PanelID:      e.PanelID,
+		Time:         e.Time / 1000000,
+		TimeEnd:      e.End() / 1000000,
+		Text:         e.Text,
+		Tags:         tags,
+	}
+}
+
+// setGrafanaTime set event time from Grafana time range (in milliseconds)
+func setGrafanaTime(e *Event, ts, tsEnd int64) {
+	e.Time = ts * 1000000
+	e.TimeEnd = 0
+	if tsEnd > ts {
+		e.TimeEnd = tsEnd * 1000000
+	}
+}
+
+func (g *GrafanaAnnotationsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "GrafanaAnnotationsHandler.onPost")
+
+	req := &grafanaAnnotationReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return http.StatusBadRequest, &grafanaMessage{Message: "bad request"}
+	}
+
+	if req.Time == 0 {
+		req.Time = time.Now().UnixNano() / 1000000
+	}
+	if req.TimeEnd != 0 && req.TimeEnd < req.Time {
+		l.Debugf("wrong time end %+v < time %+v", req.TimeEnd, req.Time)
+		return http.StatusBadRequest, &grafanaMessage{Message: "time end before time"}
+	}
+
+	event := &Event{
+		Text:         req.Text,
+		Tags:         req.Tags,
+		DashboardUID: req.DashboardUID,
+		PanelID:      req.PanelID,
+	}
+	setGrafanaTime(event, req.Time, req.TimeEnd)
+
+	if !g.Configuration.checkRetention(event, time.Now()) {
+		l.Debugf("date %d before retention time - skipping", req.Time)
+		return http.StatusNotModified, &grafanaMessage{Message: "not inserted due retention time"}
+	}
+
+	if err := g.DB.SaveEvent(event); err != nil {
+		l.Errorf("save event error: %s", err.Error())
+		eventAddError.Inc()
+		return http.StatusInternalServerError, &grafanaMessage{Message: "error"}
+	}
+
+	eventsAdded.WithLabelValues("api-grafana-annotations").Inc()
+	return http.StatusOK, &grafanaMessage{Message: "Annotation added", ID: event.ID}
+}
+
+func (g *GrafanaAnnotationsHandler) onGet(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "GrafanaAnnotationsHandler.onGet")
+
+	r.ParseForm()
+	vars := r.Form
+
+	// times in milliseconds
+	var from, to, limit int64 = 0, math.MaxInt64 / 1000000, 100
+	q := Query{
+		Name:         AnyBucket,
+		DashboardUID: vars.Get("dashboardUID"),
+		Order:        OrderDesc,
+	}
+
+	nums := map[string]*int64{"from": &from, "to": &to, "limit": &limit, "panelId": &q.PanelID}
+	for name, dst := range nums {
+		if v := vars.Get(name); v != "" {
+			num, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || num < 0 {
+				l.Debugf("wrong %s: %s", name, v)
+				return http.StatusBadRequest, &grafanaMessage{Message: "wrong " + name}
+			}
+			*dst = num
+		}
+	}
+
+	q.From = time.Unix(0, from*1000000)
+	q.To = time.Unix(0, to*1000000)
+	q.Limit = int(limit)
+
+	if tags := vars["tags"]; len(tags) > 0 {
+		exprs := make([]TagExpr, 0, len(tags))
+		for _, tag := range tags {
+			exprs = append(exprs, tagTerm(tag))
+		}
+		if vars.Get("matchAny") == "true" {
+			q.Tags = tagOr(exprs)
+		} else {
+			q.Tags = tagAnd(exprs)
+		}
+	}
+
+	if err := q.Validate(); err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, &grafanaMessage{Message: err.Error()}
+	}
+
+	ctx := r.Context()
+	return http.StatusOK, responseStreamer(func(w io.Writer) error {
+		aw := newJSONArrayWriter(w)
+		_, err := g.DB.IterEvents(ctx, q, func(e *Event) error {
+			return aw.Write(newGrafanaAnnotation(e))
+		})
+		if err != nil {
+			return err
+		}
+		return aw.Close()
+	})
+}
+
+func (g *GrafanaAnnotationsHandler) onPatch(w http.ResponseWriter, r *http.Request, l log.Logger, id string) (int, interface{}) {
+	l = l.With("action", "GrafanaAnnotationsHandler.onPatch")
+
+	req := &grafanaAnnotationPatchReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return http.StatusBadRequest, &grafanaMessage{Message: "bad request"}
+	}
+
+	_, err := g.DB.UpdateEvent(id, func(e *Event) error {
+		if req.Time != nil || req.TimeEnd != nil {
+			ts, tsEnd := e.Time/1000000, e.End()/1000000
+			if req.Time != nil {
+				ts = *req.Time
+			}
+			if req.TimeEnd != nil {
+				tsEnd = *req.TimeEnd
+			}
+			setGrafanaTime(e, ts, tsEnd)
+		}
+		if req.Text != nil {
+			e.Text = *req.Text
+		}
+		if req.Tags != nil {
+			e.Tags = *req.Tags
+		}
+		return nil
+	})
+	if err == ErrEventNotFound {
+		return http.StatusNotFound, &grafanaMessage{Message: "Annotation not found"}
+	} else if err != nil {
+		l.Errorf("update event %s error: %s", id, err.Error())
+		return http.StatusInternalServerError, &grafanaMessage{Message: "error"}
+	}
+
+	eventsUpdated.WithLabelValues("api-grafana-annotations").Inc()
+	return http.StatusOK, &grafanaMessage{Message: "Annotation patched"}
+}
+
+func (g *GrafanaAnnotationsHandler) onDelete(w http.ResponseWriter, r *http.Request, l log.Logger, id string) (int, interface{}) {
+	l = l.With("action", "GrafanaAnnotationsHandler.onDelete")
+
+	err := g.DB.DeleteEvent(id)
+	if err == ErrEventNotFound {
+		return http.StatusNotFound, &grafanaMessage{Message: "Annotation not found"}
+	} else if err != nil {
+		l.Errorf("delete event %s error: %s", id, err.Error())
+		return http.StatusInternalServerError, &grafanaMessage{Message: "error"}
+	}
+
+	return http.StatusOK, &grafanaMessage{Message: "Annotation deleted"}
+}
+
+// ServeHTTP handle requests for /api/annotations and /api/annotations/<id>
+func (g GrafanaAnnotationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, grafanaAnnotationsPath), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		code, data = g.onGet(w, r, l)
+	case id == "" && r.Method == "POST":
+		code, data = g.onPost(w, r, l)
+	case id != "" && !strings.Contains(id, "/") && r.Method == "PATCH":
+		code, data = g.onPatch(w, r, l, id)
+	case id != "" && !strings.Contains(id, "/") && r.Method == "DELETE":
+		code, data = g.onDelete(w, r, l, id)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
@@ -0,0 +1,86 @@
+//
+// api_grafana_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGrafanaAnnotations(t *testing.T) {
+	db := NewMemStore()
+
+	h := GrafanaAnnotationsHandler{Configuration: &Configuration{}, DB: db}
+
+	request := func(method, url, body string, result interface{}) int {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if result != nil {
+			if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+				t.Fatalf("decode %s %s response error: %s", method, url, err)
+			}
+		}
+		return w.Code
+	}
+
+	for _, body := range []string{
+		`{"dashboardUID":"d1","panelId":2,"time":1507037197339,"timeEnd":1507180805056,"tags":["t1","t2"],"text":"a1"}`,
+		`{"dashboardUID":"d1","panelId":3,"time":1507037198000,"tags":["t1"],"text":"a2"}`,
+		`{"dashboardUID":"d2","time":1507037199000,"text":"a3"}`,
+	} {
+		res := &grafanaMessage{}
+		if code := request("POST", "/api/annotations", body, res); code != http.StatusOK || res.ID == "" {
+			t.Fatalf("invalid post result: %d %+v", code, res)
+		}
+	}
+
+	check := func(query string, expected string) []*grafanaAnnotation {
+		var res []*grafanaAnnotation
+		if code := request("GET", "/api/annotations?"+query, "", &res); code != http.StatusOK {
+			t.Fatalf("invalid get %q result: %d", query, code)
+		}
+		var texts []string
+		for _, a := range res {
+			texts = append(texts, a.Text)
+		}
+		if strings.Join(texts, ",") != expected {
+			t.Errorf("invalid annotations for %q: %v, expected %v", query, texts, expected)
+		}
+		return res
+	}
+
+	res := check("", "a3,a2,a1")
+	if a := res[2]; a.DashboardUID != "d1" || a.PanelID != 2 || a.Time != 1507037197339 ||
+		a.TimeEnd != 1507180805056 || strings.Join(a.Tags, ",") != "t1,t2" {
+		t.Errorf("invalid annotation: %+v", a)
+	}
+	check("dashboardUID=d1", "a2,a1")
+	check("dashboardUID=d1&panelId=3", "a2")
+	check("tags=t1&tags=t2", "a1")
+	check("tags=t2&tags=xx&matchAny=true", "a1")
+	check("from=1507037198000&to=1507037198500", "a2,a1")
+	check("limit=1", "a3")
+
+	id := res[0].ID
+	if code := request("PATCH", "/api/annotations/"+id, `{"text":"a3x","tags":["t3"]}`, nil); code != http.StatusOK {
+		t.Fatalf("invalid patch result: %d", code)
+	}
+	check("tags=t3", "a3x")
+
+	if code := request("DELETE", "/api/annotations/"+id, "", nil); code != http.StatusOK {
+		t.Fatalf("invalid delete result: %d", code)
+	}
+	if code := request("DELETE", "/api/annotations/"+id, "", nil); code != http.StatusNotFound {
+		t.Fatalf("invalid delete result for missing annotation: %d", code)
+	}
+	check("", "a2,a1")
+}
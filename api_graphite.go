@@ -0,0 +1,259 @@
+//
+// api_graphite.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// graphiteEventsPath is prefix of Graphite-compatible events api
+const graphiteEventsPath = "/events/"
+
+type (
+	graphiteEventReq struct {
+		What string `json:"what"`
+		// Tags is list or string of space separated tags
+		Tags interface{} `json:"tags"`
+		Data string      `json:"data"`
+		// When is time in seconds; default now
+		When interface{} `json:"when"`
+	}
+
+	graphiteEvent struct {
+		ID   string   `json:"id"`
+		When float64  `json:"when"`
+		What string   `json:"what"`
+		Data string   `json:"data"`
+		Tags []string `json:"tags"`
+	}
+
+	// GraphiteEventsHandler implement Graphite events api (/events/)
+	GraphiteEventsHandler struct {
+		Configuration *Configuration
+		DB            EventStore
+	}
+)
+
+// graphiteUnits map Graphite relative time units to duration
+var graphiteUnits = []struct {
+	prefix string
+	unit   time.Duration
+}{
+	// longer first
+	{"mon", 30 * 24 * time.Hour},
+	{"min", time.Minute},
+	{"s", time.Second},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// parseGraphiteTime parse time in Graphite format: `now`, relative offset
+// (`-1h`, `-2days`), `HH:MM_YYYYMMDD`, `YYYYMMDD` or formats supported by
+// parseTimeIn.
+func parseGraphiteTime(t string, now time.Time) (time.Time, error) {
+	switch {
+	case t == "now":
+		return now, nil
+	case strings.HasPrefix(t, "-") || strings.HasPrefix(t, "+"):
+		end := strings.IndexFunc(t[1:], func(r rune) bool { return r < '0' || r > '9' }) + 1
+		if end < 1 {
+			break
+		}
+		num, err := strconv.ParseInt(t[1:end], 10, 64)
+		if err != nil {
+			return now, fmt.Errorf("invalid offset %q", t)
+		}
+		for _, u := range graphiteUnits {
+			if strings.HasPrefix(t[end:], u.prefix) {
+				if num > math.MaxInt64/int64(u.unit) {
+					return now, fmt.Errorf("offset out of range %q", t)
+				}
+				offset := time.Duration(num) * u.unit
+				if t[0] == '-' {
+					offset = -offset
+				}
+				return now.Add(offset), nil
+			}
+		}
+		return now, fmt.Errorf("invalid offset unit %q", t)
+	case len(t) == 14 && t[5] == '_':
+		return time.ParseInLocation("15:04_20060102", t, now.Location())
+	case len(t) == 8:
+		if ts, err := time.ParseInLocation("20060102", t, now.Location()); err == nil {
+			return ts, nil
+		}
+	}
+	return parseTimeIn(t, now)
+}
+
+func (g *GraphiteEventsHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "GraphiteEventsHandler.onPost")
+
+	req := &graphiteEventReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return http.StatusBadRequest, "bad request"
+	}
+
+	event := &Event{
+		Title: req.What,
+		Text:  req.Data,
+	}
+
+	switch tags := req.Tags.(type) {
+	case string:
+		event.SetTags(tags)
+	case []interface{}:
+		for _, tag := range tags {
+			if tag, ok := tag.(string); ok && tag != "" {
+				event.Tags = append(event.Tags, tag)
+			}
+		}
+	case nil:
+	default:
+		l.Debugf("wrong tags %+v", req.Tags)
+		return http.StatusBadRequest, "wrong tags"
+	}
+
+	switch when := req.When.(type) {
+	case float64:
+		event.Time = int64(when * float64(time.Second))
+	case nil:
+		event.Time = time.Now().UnixNano()
+	default:
+		l.Debugf("wrong time %+v", req.When)
+		return http.StatusBadRequest, "wrong time"
+	}
+
+	if !g.Configuration.checkRetention(event, time.Now()) {
+		l.Debugf("date %v before retention time - skipping", req.When)
+		return http.StatusNotModified, "not inserted due retention time"
+	}
+
+	if err := g.DB.SaveEvent(event); err != nil {
+		l.Errorf("save event error: %s", err.Error())
+		eventAddError.Inc()
+		return http.StatusInternalServerError, "error"
+	}
+
+	eventsAdded.WithLabelValues("graphite-events").Inc()
+	res := &struct {
+		ID string `json:"id"`
+	}{
+		ID: event.ID,
+	}
+	return http.StatusOK, res
+}
+
+func (g *GraphiteEventsHandler) onGetData(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "GraphiteEventsHandler.onGetData")
+
+	r.ParseForm()
+	vars := r.Form
+
+	now, err := requestNow(vars.Get("tz"))
+	if err != nil {
+		l.Debugf("wrong time zone: %s", err.Error())
+		return http.StatusBadRequest, "wrong time zone"
+	}
+
+	q := Query{
+		From: now.AddDate(0, 0, -1),
+		To:   now,
+		Name: AnyBucket,
+	}
+
+	if vfrom := vars.Get("from"); vfrom != "" {
+		if fts, err := parseGraphiteTime(vfrom, now); err == nil {
+			q.From = fts
+		} else {
+			l.Debugf("wrong from date: %s", err.Error())
+			return http.StatusBadRequest, "wrong from date"
+		}
+	}
+	if vuntil := vars.Get("until"); vuntil != "" {
+		if tts, err := parseGraphiteTime(vuntil, now); err == nil {
+			q.To = tts
+		} else {
+			l.Debugf("wrong until date: %s", err.Error())
+			return http.StatusBadRequest, "wrong until date"
+		}
+	}
+
+	var tags []TagExpr
+	for _, vtags := range vars["tags"] {
+		for _, tag := range strings.Fields(vtags) {
+			tags = append(tags, tagTerm(tag))
+		}
+	}
+	switch {
+	case len(tags) == 0:
+	case vars.Get("set_operation") == "union":
+		q.Tags = tagOr(tags)
+	default:
+		q.Tags = tagAnd(tags)
+	}
+
+	if err := q.Validate(); err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+
+	ctx := r.Context()
+	return http.StatusOK, responseStreamer(func(w io.Writer) error {
+		aw := newJSONArrayWriter(w)
+		_, err := g.DB.IterEvents(ctx, q, func(e *Event) error {
+			ge := &graphiteEvent{
+				ID:   e.ID,
+				When: float64(e.Time) / float64(time.Second),
+				What: e.Title,
+				Data: e.Text,
+				Tags: e.Tags,
+			}
+			if ge.Tags == nil {
+				ge.Tags = []string{}
+			}
+			return aw.Write(ge)
+		})
+		if err != nil {
+			return err
+		}
+		return aw.Close()
+	})
+}
+
+// ServeHTTP handle requests for /events/ and /events/get_data
+func (g GraphiteEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, graphiteEventsPath), "/")
+	switch {
+	case path == "" && r.Method == "POST":
+		code, data = g.onPost(w, r, l)
+	case path == "get_data" && r.Method == "GET":
+		code, data = g.onGetData(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
@@ -0,0 +1,97 @@
+//
+// api_graphite_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGraphiteTime(t *testing.T) {
+	now := time.Date(2017, 6, 10, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"now", now},
+		{"-1h", now.Add(-time.Hour)},
+		{"-15min", now.Add(-15 * time.Minute)},
+		{"-30s", now.Add(-30 * time.Second)},
+		{"-2days", now.Add(-48 * time.Hour)},
+		{"-1w", now.Add(-7 * 24 * time.Hour)},
+		{"-1mon", now.Add(-30 * 24 * time.Hour)},
+		{"+1d", now.Add(24 * time.Hour)},
+		{"-100y", now.Add(-100 * 365 * 24 * time.Hour)},
+		{"10:15_20170601", time.Date(2017, 6, 1, 10, 15, 0, 0, time.UTC)},
+		{"20170601", time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"1497097800", time.Unix(1497097800, 0)},
+	}
+	for _, tt := range tests {
+		res, err := parseGraphiteTime(tt.value, now)
+		if err != nil {
+			t.Errorf("parse %q error: %s", tt.value, err)
+		} else if !res.Equal(tt.expected) {
+			t.Errorf("parse %q: %v, expected %v", tt.value, res, tt.expected)
+		}
+	}
+
+	for _, value := range []string{"-1x", "-h", "yesterday?", "-99999999999y", "+300y", "-9223372036854775807s"} {
+		if _, err := parseGraphiteTime(value, now); err == nil {
+			t.Errorf("missing error for %q", value)
+		}
+	}
+}
+
+func TestGraphiteEvents(t *testing.T) {
+	db := NewMemStore()
+
+	h := GraphiteEventsHandler{Configuration: &Configuration{}, DB: db}
+	now := time.Now().Unix()
+
+	for _, body := range []string{
+		`{"what":"deploy 1","tags":["deploy","prod"],"data":"d1","when":` + strconv.FormatInt(now-7200, 10) + `}`,
+		`{"what":"deploy 2","tags":"deploy staging","data":"d2","when":` + strconv.FormatInt(now-1800, 10) + `}`,
+		`{"what":"restart","data":"d3"}`,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/events/", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("invalid post result: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	check := func(query string, expected string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/events/get_data?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("invalid get %q result: %d", query, w.Code)
+		}
+		var res []*graphiteEvent
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("decode %q response error: %s", query, err)
+		}
+		var whats []string
+		for _, e := range res {
+			whats = append(whats, e.What)
+		}
+		if strings.Join(whats, ",") != expected {
+			t.Errorf("invalid events for %q: %v, expected %v", query, whats, expected)
+		}
+	}
+
+	check("from=-3h&until=now", "deploy 1,deploy 2,restart")
+	check("from=-1h&until=now", "deploy 2,restart")
+	check("from=-3h&until=now&tags=deploy", "deploy 1,deploy 2")
+	check("from=-3h&until=now&tags=deploy+prod", "deploy 1")
+	check("from=-3h&until=now&tags=prod+staging&set_operation=union", "deploy 1,deploy 2")
+}
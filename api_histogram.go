@@ -0,0 +1,117 @@
+//
+// api_histogram.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type (
+	// histogramHandler return number of events in time steps
+	histogramHandler struct {
+		DB EventStore
+	}
+
+	histogramResp struct {
+		From    time.Time
+		To      time.Time
+		Step    string
+		Name    string
+		Tags    string
+		GroupBy string `json:",omitempty"`
+		// Times is start time of each step
+		Times  []time.Time
+		Series []*HistogramSeries
+	}
+)
+
+func (h *histogramHandler) onGet(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "histogramHandler.onGet")
+
+	r.ParseForm()
+	vars := r.Form
+
+	from, to, err := parseTimeRange(vars, 24*time.Hour)
+	if err != nil {
+		l.Debugf("wrong time range: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+
+	step := time.Hour
+	if vstep := vars.Get("step"); vstep != "" {
+		if s, err := parseDuration(vstep); err == nil {
+			step = s
+		} else {
+			l.Debugf("wrong step: %s", err.Error())
+			return http.StatusBadRequest, "wrong step"
+		}
+	}
+
+	name, tagQuery := parseName(vars.Get("name"))
+	if name == "" {
+		name = AnyBucket
+	}
+	tags, err := parseTagQuery(tagQuery, vars.Get("tags"))
+	if err != nil {
+		l.Debugf("wrong tags query: %s", err.Error())
+		return http.StatusBadRequest, "wrong tags query: " + err.Error()
+	}
+
+	q := HistogramQuery{
+		From:    from,
+		To:      to,
+		Step:    step,
+		Name:    name,
+		Tags:    tags,
+		GroupBy: vars.Get("group"),
+	}
+	if err := q.Validate(); err != nil {
+		l.Debugf("wrong query: %s", err.Error())
+		return http.StatusBadRequest, err.Error()
+	}
+
+	hist, err := h.DB.GetHistogram(q)
+	if err != nil {
+		l.Errorf("get histogram error: %s", err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+
+	resp := &histogramResp{
+		From:    from,
+		To:      to,
+		Step:    step.String(),
+		Name:    name,
+		GroupBy: q.GroupBy,
+		Times:   hist.Times(),
+		Series:  hist.Series,
+	}
+	if tags != nil {
+		resp.Tags = tags.String()
+	}
+
+	return http.StatusOK, resp
+}
+
+func (h histogramHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch r.Method {
+	case "GET":
+		code, data = h.onGet(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
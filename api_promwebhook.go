@@ -11,7 +11,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/prometheus/common/log"
+	"hash/fnv"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
@@ -48,7 +50,7 @@ type (
 	// PromWebHookHandler handle all request from AlertManager
 	PromWebHookHandler struct {
 		Configuration *Configuration
-		DB            *DB
+		DB            EventStore
 	}
 )
 
@@ -64,6 +66,31 @@ func (k kv) String() string {
 	return strings.Join(out, "\n")
 }
 
+// fingerprint calculate hash of labels in the same way as Alertmanager
+func (k kv) fingerprint() uint64 {
+	names := make([]string, 0, len(k))
+	for n := range k {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0xff})
+		h.Write([]byte(k[n]))
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// ref build reference that identify alert firing since StartsAt
+func (a *alert) ref() []byte {
+	ref, _ := marshalTS(int64(a.Labels.fingerprint()), nil)
+	startsAt, _ := marshalTS(a.StartsAt.UnixNano(), nil)
+	return append(ref, startsAt...)
+}
+
 func (p *PromWebHookHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
 	l = l.With("action", "PromWebHookHandler.onPost")
 
@@ -75,20 +102,21 @@ func (p *PromWebHookHandler) onPost(w http.ResponseWriter, r *http.Request, l lo
 
 	l.Debugf("new req from prom: %+v", m)
 
-	minDate := time.Unix(0, 0)
-	if p.Configuration.RetentionParsed != nil {
-		minDate = time.Now().Add(-(*p.Configuration.RetentionParsed))
+	now := time.Now()
+
+	res := &struct {
+		IDs []string
+	}{
+		IDs: make([]string, 0, len(m.Alerts)),
 	}
 
 	for _, a := range m.Alerts {
-		if minDate.After(a.StartsAt) {
-			l.Debugf("date %s before retention time - skipping", a.StartsAt)
-			continue
-		}
-
 		e := &Event{
 			Time: a.StartsAt.UnixNano(),
 		}
+		if a.Status == "resolved" && a.EndsAt.After(a.StartsAt) {
+			e.TimeEnd = a.EndsAt.UnixNano()
+		}
 
 		if v, ok := a.Annotations["summary"]; ok {
 			e.Title = fmt.Sprintf("[%s] %s", a.Status, strings.TrimSpace(v))
@@ -108,15 +136,25 @@ func (p *PromWebHookHandler) onPost(w http.ResponseWriter, r *http.Request, l lo
 		if v, ok := a.Labels["name"]; ok {
 			e.Name = strings.TrimSpace(v)
 		}
-		if err := p.DB.SaveEvent(e); err != nil {
+		if !p.Configuration.checkRetention(e, now) {
+			l.Debugf("date %s before retention time - skipping", a.StartsAt)
+			continue
+		}
+		created, err := p.DB.UpsertEvent(a.ref(), e)
+		if err != nil {
 			l.Errorf("save event error: %s", err)
 			eventAddError.Inc()
-		} else {
+			continue
+		}
+		if created {
 			eventsAdded.WithLabelValues("api-v1-promwebhook-post").Inc()
+		} else {
+			eventsUpdated.WithLabelValues("api-v1-promwebhook-post").Inc()
 		}
+		res.IDs = append(res.IDs, e.ID)
 	}
 
-	return http.StatusOK, m
+	return http.StatusOK, res
 }
 
 func (p PromWebHookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
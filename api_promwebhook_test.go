@@ -0,0 +1,104 @@
+//
+// api_promwebhook_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromWebHook(t *testing.T) {
+	db := NewMemStore()
+
+	h := PromWebHookHandler{Configuration: &Configuration{}, DB: db}
+	startsAt := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	endsAt := startsAt.Add(10 * time.Minute)
+
+	alertJSON := func(status, instance string, startsAt, endsAt time.Time) string {
+		return fmt.Sprintf(`{"status": %q,
+			"labels": {"alertname": "disk", "instance": %q, "name": "alerts", "tags": "t1 t2"},
+			"annotations": {"summary": "disk full"},
+			"startsAt": %q, "endsAt": %q}`, status, instance,
+			startsAt.Format(time.RFC3339), endsAt.Format(time.RFC3339))
+	}
+
+	post := func(alerts ...string) []string {
+		body := `{"status": "firing", "alerts": [` + strings.Join(alerts, ",") + `]}`
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/promwebhook", strings.NewReader(body)))
+		res := &struct {
+			IDs []string
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+			t.Fatalf("decode response error: %s", err)
+		}
+		if w.Code != http.StatusOK || len(res.IDs) != len(alerts) {
+			t.Fatalf("invalid response: %d %+v", w.Code, res)
+		}
+		return res.IDs
+	}
+
+	getEvents := func() []*Event {
+		events, _, err := db.GetEvents(Query{From: startsAt.Add(-time.Hour),
+			To: startsAt.Add(2 * time.Hour), Name: AnyBucket})
+		if err != nil {
+			t.Fatalf("get events error: %s", err)
+		}
+		return events
+	}
+
+	// alerts from one group start at the same time
+	ids := post(alertJSON("firing", "h1", startsAt, time.Time{}),
+		alertJSON("firing", "h2", startsAt, time.Time{}))
+	if ids[0] == ids[1] {
+		t.Fatalf("expected events for each alert, got %v", ids)
+	}
+	id := ids[0]
+	e, err := db.GetEvent(id)
+	if err != nil {
+		t.Fatalf("get event error: %s", err)
+	}
+	if e.Name != "alerts" || e.Title != "[firing] disk full" || e.Time != startsAt.UnixNano() ||
+		e.TimeEnd != 0 || strings.Join(e.Tags, ",") != "t1,t2" {
+		t.Errorf("invalid event for firing alert: %+v", e)
+	}
+
+	// repeated notification update event
+	if ids := post(alertJSON("firing", "h1", startsAt, time.Time{})); ids[0] != id {
+		t.Errorf("expected updated event %s, got %v", id, ids)
+	}
+	if events := getEvents(); len(events) != 2 {
+		t.Errorf("expected 2 events after repeat, got %d", len(events))
+	}
+
+	// resolved alert set event end
+	if ids := post(alertJSON("resolved", "h1", startsAt, endsAt)); ids[0] != id {
+		t.Errorf("expected updated event %s, got %v", id, ids)
+	}
+	if e, err := db.GetEvent(id); err != nil || e.TimeEnd != endsAt.UnixNano() ||
+		e.Title != "[resolved] disk full" {
+		t.Errorf("invalid event for resolved alert: %+v, %v", e, err)
+	}
+	if events := getEvents(); len(events) != 2 {
+		t.Errorf("expected 2 events after resolve, got %d", len(events))
+	}
+
+	// alert firing again create new event
+	ids = post(alertJSON("firing", "h1", startsAt.Add(time.Hour), time.Time{}))
+	if ids[0] == id {
+		t.Errorf("expected new event for new startsAt, got %v", ids)
+	}
+	if events := getEvents(); len(events) != 3 {
+		t.Errorf("expected 3 events after new firing, got %d", len(events))
+	}
+}
@@ -0,0 +1,331 @@
+//
+// api_simplejson.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type (
+	simpleJSONSearchReq struct {
+		Target string `json:"target"`
+	}
+
+	simpleJSONTarget struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		// Type is "timeserie" (default) or "table"
+		Type string `json:"type"`
+	}
+
+	simpleJSONFilter struct {
+		Key      string `json:"key"`
+		Operator string `json:"operator"`
+		Value    string `json:"value"`
+	}
+
+	simpleJSONQueryReq struct {
+		Range         annotationReqRange `json:"range"`
+		IntervalMs    int64              `json:"intervalMs"`
+		MaxDataPoints int                `json:"maxDataPoints"`
+		Targets       []simpleJSONTarget `json:"targets"`
+		AdhocFilters  []simpleJSONFilter `json:"adhocFilters"`
+	}
+
+	simpleJSONSeries struct {
+		Target string `json:"target"`
+		// Datapoints is list of [value, time in milliseconds]
+		Datapoints [][2]int64 `json:"datapoints"`
+	}
+
+	simpleJSONColumn struct {
+		Text string `json:"text"`
+		Type string `json:"type"`
+	}
+
+	simpleJSONTable struct {
+		Type    string             `json:"type"`
+		Columns []simpleJSONColumn `json:"columns"`
+		Rows    [][]interface{}    `json:"rows"`
+	}
+
+	simpleJSONTagKey struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+
+	simpleJSONTagValuesReq struct {
+		Key string `json:"key"`
+	}
+
+	simpleJSONTagValue struct {
+		Text string `json:"text"`
+	}
+
+	// SimpleJSONHandler implement Grafana SimpleJSON datasource api
+	// (except /annotations handled by AnnotationHandler)
+	SimpleJSONHandler struct {
+		DB EventStore
+	}
+)
+
+// Ad-hoc filter keys
+const (
+	simpleJSONKeyName = "name"
+	simpleJSONKeyTag  = "tag"
+)
+
+var simpleJSONTableColumns = []simpleJSONColumn{
+	{Text: "Time", Type: "time"},
+	{Text: "TimeEnd", Type: "time"},
+	{Text: "Name", Type: "string"},
+	{Text: "Title", Type: "string"},
+	{Text: "Text", Type: "string"},
+	{Text: "Tags", Type: "string"},
+	{Text: "ID", Type: "string"},
+}
+
+func (s *SimpleJSONHandler) onSearch(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "SimpleJSONHandler.onSearch")
+
+	req := &simpleJSONSearchReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return 442, "bad request"
+	}
+
+	names, err := s.DB.GetNames()
+	if err != nil {
+		l.Errorf("get names error: %s", err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+
+	res := make([]string, 0, len(names)+1)
+	for _, name := range append([]string{AnyBucket}, names...) {
+		if strings.HasPrefix(name, req.Target) {
+			res = append(res, name)
+		}
+	}
+
+	return http.StatusOK, res
+}
+
+// targetQuery create query for `target` in form `name:tags query` limited by
+// ad-hoc `filters`. Return nil query when filters exclude all events.
+func (s *SimpleJSONHandler) targetQuery(target string, filters []simpleJSONFilter) (*Query, error) {
+	name, tagQuery := parseName(target)
+	if name == "" {
+		name = AnyBucket
+	}
+
+	tags, err := parseTagQuery(tagQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var exprs tagAnd
+	if tags != nil {
+		exprs = append(exprs, tags)
+	}
+
+	for _, f := range filters {
+		switch {
+		case f.Key == simpleJSONKeyName && f.Operator == "=":
+			if name != AnyBucket && name != f.Value {
+				return nil, nil
+			}
+			name = f.Value
+		case f.Key == simpleJSONKeyTag && f.Operator == "=":
+			exprs = append(exprs, tagTerm(f.Value))
+		case f.Key == simpleJSONKeyTag && f.Operator == "!=":
+			exprs = append(exprs, tagNot{tagTerm(f.Value)})
+		default:
+			return nil, fmt.Errorf("unsupported filter '%s %s'", f.Key, f.Operator)
+		}
+	}
+
+	q := &Query{Name: name}
+	switch len(exprs) {
+	case 0:
+	case 1:
+		q.Tags = exprs[0]
+	default:
+		q.Tags = exprs
+	}
+	return q, nil
+}
+
+// queryStep compute histogram step for request
+func (req *simpleJSONQueryReq) queryStep(from, to time.Time) time.Duration {
+	step := time.Duration(req.IntervalMs) * time.Millisecond
+	if req.MaxDataPoints > 0 {
+		if s := to.Sub(from) / time.Duration(req.MaxDataPoints); s > step {
+			step = s
+		}
+	}
+	if s := to.Sub(from)/maxHistogramSteps + 1; s > step {
+		step = s
+	}
+	return step
+}
+
+func (s *SimpleJSONHandler) onQuery(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "SimpleJSONHandler.onQuery")
+
+	req := &simpleJSONQueryReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return 442, "bad request"
+	}
+
+	from, err := parseTime(req.Range.From)
+	if err != nil {
+		l.Debugf("wrong from date: %s", err.Error())
+		return http.StatusBadRequest, "wrong from date: " + err.Error()
+	}
+	to, err := parseTime(req.Range.To)
+	if err != nil {
+		l.Debugf("wrong to date: %s", err.Error())
+		return http.StatusBadRequest, "wrong to date: " + err.Error()
+	}
+	if to.Before(from) {
+		l.Debugf("wrong to dates to < from")
+		return http.StatusBadRequest, "'to' < 'from'"
+	}
+
+	step := req.queryStep(from, to)
+
+	res := make([]interface{}, 0, len(req.Targets))
+	for _, target := range req.Targets {
+		q, err := s.targetQuery(target.Target, req.AdhocFilters)
+		if err != nil {
+			l.Debugf("wrong target %q: %s", target.Target, err.Error())
+			return http.StatusBadRequest, "wrong target: " + err.Error()
+		}
+
+		if target.Type == "table" {
+			table := &simpleJSONTable{
+				Type:    "table",
+				Columns: simpleJSONTableColumns,
+				Rows:    [][]interface{}{},
+			}
+			if q != nil {
+				q.From, q.To = from, to
+				_, err = s.DB.IterEvents(r.Context(), *q, func(e *Event) error {
+					table.Rows = append(table.Rows, []interface{}{
+						e.Time / 1000000, e.End() / 1000000, e.Name, e.Title, e.Text,
+						strings.Join(e.Tags, " "), e.ID,
+					})
+					return nil
+				})
+				if err != nil {
+					l.Errorf("get events error: %s", err.Error())
+					return http.StatusInternalServerError, "error"
+				}
+			}
+			res = append(res, table)
+			continue
+		}
+
+		series := &simpleJSONSeries{Target: target.Target, Datapoints: [][2]int64{}}
+		if q != nil {
+			hq := HistogramQuery{From: from, To: to, Step: step, Name: q.Name, Tags: q.Tags}
+			if err := hq.Validate(); err != nil {
+				l.Debugf("wrong histogram query: %s", err.Error())
+				return http.StatusBadRequest, err.Error()
+			}
+			hist, err := s.DB.GetHistogram(hq)
+			if err != nil {
+				l.Errorf("get histogram error: %s", err.Error())
+				return http.StatusInternalServerError, "error"
+			}
+			times := hist.Times()
+			for i, cnt := range hist.Series[0].Counts {
+				series.Datapoints = append(series.Datapoints,
+					[2]int64{int64(cnt), times[i].UnixNano() / 1000000})
+			}
+		}
+		res = append(res, series)
+	}
+
+	return http.StatusOK, res
+}
+
+func (s *SimpleJSONHandler) onTagKeys(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	return http.StatusOK, []simpleJSONTagKey{
+		{Type: "string", Text: simpleJSONKeyName},
+		{Type: "string", Text: simpleJSONKeyTag},
+	}
+}
+
+func (s *SimpleJSONHandler) onTagValues(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "SimpleJSONHandler.onTagValues")
+
+	req := &simpleJSONTagValuesReq{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		l.Debugf("body decode error: %s", err)
+		return 442, "bad request"
+	}
+
+	var values []string
+	var err error
+	switch req.Key {
+	case simpleJSONKeyName:
+		values, err = s.DB.GetNames()
+	case simpleJSONKeyTag:
+		values, err = s.DB.GetTags()
+	default:
+		return http.StatusBadRequest, "unknown key"
+	}
+	if err != nil {
+		l.Errorf("get %s values error: %s", req.Key, err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+
+	res := make([]simpleJSONTagValue, 0, len(values))
+	for _, v := range values {
+		res = append(res, simpleJSONTagValue{Text: v})
+	}
+	return http.StatusOK, res
+}
+
+func (s SimpleJSONHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch r.Method {
+	case "POST":
+		switch r.URL.Path {
+		case "/search":
+			code, data = s.onSearch(w, r, l)
+		case "/query":
+			code, data = s.onQuery(w, r, l)
+		case "/tag-keys":
+			code, data = s.onTagKeys(w, r, l)
+		case "/tag-values":
+			code, data = s.onTagValues(w, r, l)
+		}
+	case "OPTIONS":
+		code, data = http.StatusOK, ""
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Add("Access-Control-Allow-Headers", "accept, content-type")
+	w.Header().Add("Access-Control-Allow-Methods", "POST")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
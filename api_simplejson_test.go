@@ -0,0 +1,184 @@
+//
+// api_simplejson_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimpleJSONTargetQuery(t *testing.T) {
+	h := SimpleJSONHandler{}
+
+	tests := []struct {
+		target  string
+		filters []simpleJSONFilter
+		name    string
+		tags    string
+	}{
+		{"deploy:t1", nil, "deploy", "t1"},
+		{"", []simpleJSONFilter{{"name", "=", "alerts"}}, "alerts", ""},
+		{"alerts", []simpleJSONFilter{{"name", "=", "alerts"}}, "alerts", ""},
+		{"_any_:t1", []simpleJSONFilter{{"tag", "=", "t2"}, {"tag", "!=", "t3"}},
+			AnyBucket, "t1 AND t2 AND NOT t3"},
+		{"", []simpleJSONFilter{{"tag", "!=", "t3"}}, AnyBucket, "NOT t3"},
+	}
+	for _, tc := range tests {
+		q, err := h.targetQuery(tc.target, tc.filters)
+		if err != nil || q == nil {
+			t.Errorf("target %q %v: invalid result %v, %v", tc.target, tc.filters, q, err)
+			continue
+		}
+		tags := ""
+		if q.Tags != nil {
+			tags = q.Tags.String()
+		}
+		if q.Name != tc.name || tags != tc.tags {
+			t.Errorf("target %q %v: invalid query %q %q", tc.target, tc.filters, q.Name, tags)
+		}
+	}
+
+	// filters exclude all events
+	if q, err := h.targetQuery("deploy", []simpleJSONFilter{{"name", "=", "alerts"}}); q != nil || err != nil {
+		t.Errorf("expected empty query, got %+v, %v", q, err)
+	}
+	for _, f := range []simpleJSONFilter{{"name", "!=", "alerts"}, {"other", "=", "x"}} {
+		if _, err := h.targetQuery("", []simpleJSONFilter{f}); err == nil {
+			t.Errorf("expected error for filter %v", f)
+		}
+	}
+	if _, err := h.targetQuery("deploy:(t1", nil); err == nil {
+		t.Errorf("expected error for wrong tags query")
+	}
+}
+
+func TestSimpleJSON(t *testing.T) {
+	db := NewMemStore()
+
+	base := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{Name: "deploy", Title: "d1", Time: base.UnixNano(), Tags: []string{"t1", "t2"}},
+		{Name: "deploy", Title: "d2", Time: base.Add(time.Hour).UnixNano(),
+			TimeEnd: base.Add(90 * time.Minute).UnixNano(), Tags: []string{"t1"}},
+		{Name: "alerts", Title: "a1", Time: base.Add(90 * time.Minute).UnixNano(), Tags: []string{"t2"}},
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+
+	h := SimpleJSONHandler{DB: db}
+
+	request := func(path, body string, result interface{}) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if result != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+				t.Fatalf("decode %s response error: %s", path, err)
+			}
+		}
+		return w.Code
+	}
+
+	// search
+	for target, expected := range map[string][]string{
+		"":   {AnyBucket, "__default__", "alerts", "deploy"},
+		"de": {"deploy"},
+		"x":  {},
+	} {
+		var res []string
+		if code := request("/search", fmt.Sprintf(`{"target": %q}`, target), &res); code != http.StatusOK {
+			t.Fatalf("invalid search result: %d", code)
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("invalid search result for %q: %v, expected %v", target, res, expected)
+		}
+	}
+
+	// query timeserie
+	query := func(target, typ, filters string) string {
+		return fmt.Sprintf(`{"range": {"from": %q, "to": %q}, "intervalMs": 3600000,
+			"targets": [{"target": %q, "refId": "A", "type": %q}], "adhocFilters": [%s]}`,
+			base.Format(time.RFC3339), base.Add(2*time.Hour).Format(time.RFC3339), target, typ, filters)
+	}
+	ts0, ts1 := base.UnixNano()/1000000, base.Add(time.Hour).UnixNano()/1000000
+	for _, tt := range []struct {
+		target   string
+		filters  string
+		expected [][2]int64
+	}{
+		{"_any_", "", [][2]int64{{1, ts0}, {2, ts1}}},
+		{"deploy", "", [][2]int64{{1, ts0}, {1, ts1}}},
+		{"_any_:t2", "", [][2]int64{{1, ts0}, {1, ts1}}},
+		{"_any_", `{"key": "name", "operator": "=", "value": "alerts"}`, [][2]int64{{0, ts0}, {1, ts1}}},
+		{"_any_", `{"key": "tag", "operator": "!=", "value": "t2"}`, [][2]int64{{0, ts0}, {1, ts1}}},
+		{"deploy", `{"key": "name", "operator": "=", "value": "alerts"}`, [][2]int64{}},
+	} {
+		var res []*simpleJSONSeries
+		if code := request("/query", query(tt.target, "timeserie", tt.filters), &res); code != http.StatusOK {
+			t.Fatalf("invalid query %q %s result: %d", tt.target, tt.filters, code)
+		}
+		if len(res) != 1 || res[0].Target != tt.target || !reflect.DeepEqual(res[0].Datapoints, tt.expected) {
+			t.Errorf("invalid series for %q %s: %+v, expected %v", tt.target, tt.filters, res, tt.expected)
+		}
+	}
+
+	// query table
+	var tables []*simpleJSONTable
+	if code := request("/query", query("deploy:t1", "table", ""), &tables); code != http.StatusOK {
+		t.Fatalf("invalid table query result: %d", code)
+	}
+	if len(tables) != 1 || tables[0].Type != "table" || len(tables[0].Columns) != 7 || len(tables[0].Rows) != 2 {
+		t.Fatalf("invalid table: %+v", tables)
+	}
+	row := tables[0].Rows[1]
+	expectedRow := []interface{}{float64(ts1), float64(base.Add(90*time.Minute).UnixNano() / 1000000),
+		"deploy", "d2", "", "t1", events[1].ID}
+	if !reflect.DeepEqual(row, expectedRow) {
+		t.Errorf("invalid table row: %v, expected %v", row, expectedRow)
+	}
+
+	// wrong queries
+	for _, body := range []string{
+		query("_any_", "timeserie", `{"key": "name", "operator": "!=", "value": "alerts"}`),
+		`{"range": {"from": "now", "to": "now-1h"}, "targets": [{"target": "_any_"}]}`,
+		// range too wide for histogram
+		`{"range": {"from": "1970-01-01T00:00:00Z", "to": "5138-11-16T09:46:39Z"}, "targets": [{"target": "_any_"}]}`,
+	} {
+		if code := request("/query", body, nil); code != http.StatusBadRequest {
+			t.Errorf("invalid result for %s: %d", body, code)
+		}
+	}
+
+	// tag keys and values
+	var keys []simpleJSONTagKey
+	if code := request("/tag-keys", "{}", &keys); code != http.StatusOK || len(keys) != 2 ||
+		keys[0].Text != simpleJSONKeyName || keys[1].Text != simpleJSONKeyTag {
+		t.Errorf("invalid tag keys: %d %+v", code, keys)
+	}
+	for key, expected := range map[string][]simpleJSONTagValue{
+		"name": {{"__default__"}, {"alerts"}, {"deploy"}},
+		"tag":  {{"t1"}, {"t2"}},
+	} {
+		var values []simpleJSONTagValue
+		if code := request("/tag-values", fmt.Sprintf(`{"key": %q}`, key), &values); code != http.StatusOK {
+			t.Fatalf("invalid tag values result: %d", code)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("invalid values for %q: %v, expected %v", key, values, expected)
+		}
+	}
+	if code := request("/tag-values", `{"key": "other"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid result for unknown key: %d", code)
+	}
+}
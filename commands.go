@@ -0,0 +1,235 @@
+//
+// commands.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const commandsUsage = `Commands:
+  reindex    rebuild all indexes
+  export [filters] [file]
+             export events as JSON Lines into file (default stdout)
+  import [filters] [file]
+             import events from JSON Lines file (default stdin)
+  restore <file>
+             replace database by backup file; server must be stopped
+  compact    copy database into new file to reclaim free space
+  migrate [file]
+             copy events from bolt database into SQLite database file
+             (default sqlite_file from configuration)
+
+Filters:
+  -from, -to  time range
+  -name       bucket name; default all buckets
+  -tags       tags query
+`
+
+// runCommand execute offline command given in command line; return exit code
+func runCommand(c *Configuration, args []string) int {
+	var err error
+
+	switch args[0] {
+	case "reindex":
+		err = cmdReindex(c, args[1:])
+	case "export":
+		err = cmdExport(c, args[1:])
+	case "import":
+		err = cmdImport(c, args[1:])
+	case "restore":
+		err = cmdRestore(c, args[1:])
+	case "compact":
+		err = cmdCompact(c, args[1:])
+	case "migrate":
+		err = cmdMigrate(c, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", args[0], commandsUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s error: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func cmdReindex(c *Configuration, args []string) error {
+	db, err := DBOpen(c.DBFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	indexed, err := db.RebuildIndexes()
+	if err == nil {
+		fmt.Printf("indexed %d events\n", indexed)
+	}
+	return err
+}
+
+// parseFilterArgs parse command arguments with events filters; return query
+// and remaining arguments
+func parseFilterArgs(name string, args []string) (Query, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	from := fs.String("from", "", "events from time")
+	to := fs.String("to", "", "events to time")
+	bname := fs.String("name", "", "bucket name")
+	tags := fs.String("tags", "", "tags query")
+	if err := fs.Parse(args); err != nil {
+		return Query{}, nil, err
+	}
+	q, err := exportQuery(*from, *to, *bname, *tags)
+	return q, fs.Args(), err
+}
+
+func cmdExport(c *Configuration, args []string) error {
+	q, args, err := parseFilterArgs("export", args)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	db, err := OpenStore(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := bufio.NewWriter(out)
+	exported, err := db.ExportEvents(context.Background(), w, q)
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d events\n", exported)
+	return nil
+}
+
+func cmdImport(c *Configuration, args []string) error {
+	q, args, err := parseFilterArgs("import", args)
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	db, err := OpenStore(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	imported, skipped, err := db.ImportEvents(in, q)
+	fmt.Fprintf(os.Stderr, "imported %d events, skipped %d\n", imported, skipped)
+	return err
+}
+
+func cmdRestore(c *Configuration, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("missing backup file name")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmpname, err := prepareRestore(f, c.DBFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+
+	// make sure database is not used by running server
+	if _, err := os.Stat(c.DBFile); err == nil {
+		bdb, err := bolt.Open(c.DBFile, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return fmt.Errorf("open database %s error (is server running?): %s", c.DBFile, err)
+		}
+		bdb.Close()
+	}
+
+	if err := os.Rename(tmpname, c.DBFile); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "database restored from %s\n", args[0])
+	return nil
+}
+
+func cmdCompact(c *Configuration, args []string) error {
+	db, err := DBOpen(c.DBFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Compact()
+	if err == nil {
+		fmt.Printf("database compacted; size %d -> %d\n", res.SizeBefore, res.SizeAfter)
+	}
+	return err
+}
+
+func cmdMigrate(c *Configuration, args []string) error {
+	filename := c.SQLiteFile
+	if len(args) > 0 {
+		filename = args[0]
+	}
+
+	// don't create empty bolt database
+	if _, err := os.Stat(c.DBFile); err != nil {
+		return err
+	}
+
+	db, err := DBOpen(c.DBFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := OpenSQLiteStore(filename)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	copied, err := s.MigrateFromBolt(db)
+	if err == nil {
+		fmt.Printf("copied %d events into %s\n", copied, filename)
+	}
+	return err
+}
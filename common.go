@@ -9,6 +9,7 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -25,7 +26,25 @@ func intToTime(ts int64) time.Time {
 	return time.Unix(ts, 0)
 }
 
+// absoluteTimeLayouts are layouts without zone; times are parsed in location
+// of reference time
+var absoluteTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime parse time relative to current time in UTC; see parseTimeIn
 func parseTime(t string) (time.Time, error) {
+	return parseTimeIn(t, time.Now().UTC())
+}
+
+// parseTimeIn parse time given as unix timestamp (seconds, millis, micros or
+// nanos), RFC3339, layouts without zone (parsed in `now` location) or
+// expression relative to `now` (see parseRelativeTime).
+func parseTimeIn(t string, now time.Time) (time.Time, error) {
 	if t == "" {
 		return time.Time{}, fmt.Errorf("missing value")
 	}
@@ -35,13 +54,176 @@ func parseTime(t string) (time.Time, error) {
 	if ts, err := strconv.ParseInt(t, 10, 64); err == nil {
 		return intToTime(ts), nil
 	}
+	if ts, ok, err := parseRelativeTime(t, now); ok {
+		return ts, err
+	}
 	if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
 		return ts, nil
 	}
 	if ts, err := time.Parse(time.RFC3339, t); err == nil {
 		return ts, nil
 	}
-	return time.Parse("2006-01-02T15:04:05", t)
+	for _, layout := range absoluteTimeLayouts {
+		if ts, err := time.ParseInLocation(layout, t, now.Location()); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", t)
+}
+
+// parseRelativeTime parse Grafana-like expressions: `now`, `now-6h`,
+// `now+1d`, `now/d` (round down to start of day), `now-1d/d`, `today`,
+// `yesterday` and `2d` (as `now-2d`; signed short form like `-2d` is not
+// accepted). Number before unit is required. Units: s, m (minutes), h, d, w,
+// M (months), y. Weeks start on Monday. Return false when `t` is not
+// relative time.
+func parseRelativeTime(t string, now time.Time) (time.Time, bool, error) {
+	switch strings.ToLower(t) {
+	case "now":
+		return now, true, nil
+	case "today":
+		return roundTime(now, 'd'), true, nil
+	case "yesterday":
+		return roundTime(now, 'd').AddDate(0, 0, -1), true, nil
+	}
+
+	// keywords are case insensitive; units are not (`m` - minute, `M` - month)
+	if len(t) < 3 || !strings.EqualFold(t[:3], "now") {
+		// short form: `2d`; only unsigned number is accepted
+		if len(t) < 2 || !isTimeUnit(t[len(t)-1]) || !isDigits(t[:len(t)-1]) {
+			return now, false, nil
+		}
+		num, err := strconv.Atoi(t[:len(t)-1])
+		if err != nil {
+			return now, false, nil
+		}
+		return addTime(now, -num, t[len(t)-1]), true, nil
+	}
+
+	ts := now
+	expr := t[3:]
+	for len(expr) > 0 {
+		op := expr[0]
+		expr = expr[1:]
+		switch op {
+		case '+', '-':
+			end := strings.IndexFunc(expr, func(r rune) bool { return r < '0' || r > '9' })
+			if end <= 0 || !isTimeUnit(expr[end]) {
+				return now, true, fmt.Errorf("invalid time expression %q", t)
+			}
+			num, err := strconv.Atoi(expr[:end])
+			if err != nil {
+				return now, true, fmt.Errorf("invalid time expression %q", t)
+			}
+			if op == '-' {
+				num = -num
+			}
+			ts = addTime(ts, num, expr[end])
+			expr = expr[end+1:]
+		case '/':
+			if len(expr) == 0 || !isTimeUnit(expr[0]) {
+				return now, true, fmt.Errorf("invalid time expression %q", t)
+			}
+			ts = roundTime(ts, expr[0])
+			expr = expr[1:]
+		default:
+			return now, true, fmt.Errorf("invalid time expression %q", t)
+		}
+	}
+	return ts, true, nil
+}
+
+// isDigits check if `s` contains only decimal digits
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isTimeUnit(u byte) bool {
+	return strings.IndexByte("smhdwMy", u) >= 0
+}
+
+// addTime add `num` units to `t`; days and longer units respect calendar
+func addTime(t time.Time, num int, unit byte) time.Time {
+	switch unit {
+	case 's':
+		return t.Add(time.Duration(num) * time.Second)
+	case 'm':
+		return t.Add(time.Duration(num) * time.Minute)
+	case 'h':
+		return t.Add(time.Duration(num) * time.Hour)
+	case 'd':
+		return t.AddDate(0, 0, num)
+	case 'w':
+		return t.AddDate(0, 0, 7*num)
+	case 'M':
+		return t.AddDate(0, num, 0)
+	case 'y':
+		return t.AddDate(num, 0, 0)
+	}
+	return t
+}
+
+// roundTime round `t` down to start of `unit` in `t` location
+func roundTime(t time.Time, unit byte) time.Time {
+	y, m, d := t.Date()
+	switch unit {
+	case 's':
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	case 'm':
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location())
+	case 'h':
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case 'd':
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case 'w':
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case 'M':
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	case 'y':
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// requestNow return current time in time zone `tz` (IANA name); UTC when
+// `tz` is empty
+func requestNow(tz string) (time.Time, error) {
+	if tz == "" {
+		return time.Now().UTC(), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().In(loc), nil
+}
+
+// parseTimeRange parse `from` and `to` request params in time zone given by
+// `tz` param. When not given, `to` is now and `from` is now - `span`.
+func parseTimeRange(vars url.Values, span time.Duration) (from, to time.Time, err error) {
+	now, err := requestNow(vars.Get("tz"))
+	if err != nil {
+		return from, to, fmt.Errorf("wrong time zone: %s", err)
+	}
+
+	to, from = now, now.Add(-span)
+
+	if vfrom := vars.Get("from"); vfrom != "" {
+		if from, err = parseTimeIn(vfrom, now); err != nil {
+			return from, to, fmt.Errorf("wrong from date: %s", err)
+		}
+	}
+	if vto := vars.Get("to"); vto != "" {
+		if to, err = parseTimeIn(vto, now); err != nil {
+			return from, to, fmt.Errorf("wrong to date: %s", err)
+		}
+	}
+	return from, to, nil
 }
 
 func numToUnixNano(ts int64) int64 {
@@ -55,17 +237,41 @@ func numToUnixNano(ts int64) int64 {
 	return ts * 1000000000
 }
 
-func parseName(n string) (name string, tags []string) {
+// parseName split `n` in form `name:tags query` into bucket name and tags
+// query; more than one `:` is allowed and act as AND (`name:tag1:tag2`).
+func parseName(n string) (name string, tagQuery string) {
 	if n == "" {
-		return "", nil
+		return "", ""
 	}
 	fields := strings.Split(n, ":")
 	name = fields[0]
 	if len(fields) > 1 {
-		tags = fields[1:]
-	}
-	if len(tags) == 0 {
-		tags = nil
+		tagQuery = strings.Join(fields[1:], " ")
 	}
 	return
 }
+
+// parseDuration parse duration given as number of seconds or in Go format;
+// additionally `d` (day) and `w` (week) units are supported (ie. `1d`).
+func parseDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+	if sec, err := strconv.ParseInt(d, 10, 64); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	unit := time.Duration(0)
+	switch d[len(d)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(d)
+	}
+	num, err := strconv.ParseInt(d[:len(d)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", d)
+	}
+	return time.Duration(num) * unit, nil
+}
@@ -0,0 +1,131 @@
+//
+// common_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTimeIn(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skipf("missing time zone data: %s", err)
+	}
+
+	// Wednesday
+	now := time.Date(2017, 6, 14, 12, 34, 56, 789, time.UTC)
+	nowWaw := now.In(warsaw)
+
+	tests := []struct {
+		value    string
+		now      time.Time
+		expected time.Time
+	}{
+		// absolute
+		{"1497443696", now, time.Unix(1497443696, 0)},
+		{"1497443696000", now, time.Unix(1497443696, 0)},
+		{"2017-06-01T10:00:00Z", now, time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"2017-06-01T10:00:00+02:00", nowWaw, time.Date(2017, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2017-06-01T10:00:00", now, time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)},
+		{"2017-06-01T10:00:00", nowWaw, time.Date(2017, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2017-06-01 10:00", nowWaw, time.Date(2017, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2017-06-01", now, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"2017-06-01", nowWaw, time.Date(2017, 5, 31, 22, 0, 0, 0, time.UTC)},
+		// relative
+		{"now", now, now},
+		{"NOW", now, now},
+		{"now-6h", now, now.Add(-6 * time.Hour)},
+		{"NOW-6h", now, now.Add(-6 * time.Hour)},
+		{"Now-1M", now, now.AddDate(0, -1, 0)},
+		{"now+15m", now, now.Add(15 * time.Minute)},
+		{"now-30s", now, now.Add(-30 * time.Second)},
+		{"now-1d", now, now.AddDate(0, 0, -1)},
+		{"now-2w", now, now.AddDate(0, 0, -14)},
+		{"now-1M", now, now.AddDate(0, -1, 0)},
+		{"now-1y", now, now.AddDate(-1, 0, 0)},
+		{"now-1d-2h", now, now.AddDate(0, 0, -1).Add(-2 * time.Hour)},
+		{"2d", now, now.AddDate(0, 0, -2)},
+		{"90m", now, now.Add(-90 * time.Minute)},
+		// rounding
+		{"now/s", now, time.Date(2017, 6, 14, 12, 34, 56, 0, time.UTC)},
+		{"now/m", now, time.Date(2017, 6, 14, 12, 34, 0, 0, time.UTC)},
+		{"now/h", now, time.Date(2017, 6, 14, 12, 0, 0, 0, time.UTC)},
+		{"now/d", now, time.Date(2017, 6, 14, 0, 0, 0, 0, time.UTC)},
+		{"now/d", nowWaw, time.Date(2017, 6, 13, 22, 0, 0, 0, time.UTC)},
+		{"now-1d/d", now, time.Date(2017, 6, 13, 0, 0, 0, 0, time.UTC)},
+		{"now/w", now, time.Date(2017, 6, 12, 0, 0, 0, 0, time.UTC)},
+		{"now/M", now, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"now/y", now, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"now/d+8h", now, time.Date(2017, 6, 14, 8, 0, 0, 0, time.UTC)},
+		{"today", now, time.Date(2017, 6, 14, 0, 0, 0, 0, time.UTC)},
+		{"TODAY", now, time.Date(2017, 6, 14, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", now, time.Date(2017, 6, 13, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", nowWaw, time.Date(2017, 6, 12, 22, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		res, err := parseTimeIn(tt.value, tt.now)
+		if err != nil {
+			t.Errorf("parse %q (%s) error: %s", tt.value, tt.now.Location(), err)
+		} else if !res.Equal(tt.expected) {
+			t.Errorf("parse %q (%s): %v, expected %v", tt.value, tt.now.Location(),
+				res, tt.expected)
+		}
+	}
+
+	for _, value := range []string{"", "now-", "now-6", "now-6x", "now-h", "NOW-6x", "no", "now+d", "now/",
+		"now/x", "now*2", "2x", "d", "-1h", "+1h", "-2d", "tomorrow", "2017-13-01"} {
+		if res, err := parseTimeIn(value, now); err == nil {
+			t.Errorf("missing error for %q: %v", value, res)
+		}
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		from, to string
+	}{
+		{"from=2017-06-01&to=2017-06-02", "2017-06-01T00:00:00Z", "2017-06-02T00:00:00Z"},
+		{"from=2017-06-01T10:00:00&to=2017-06-02&tz=UTC",
+			"2017-06-01T10:00:00Z", "2017-06-02T00:00:00Z"},
+		{"from=2017-06-01T10:00:00&to=2017-06-01T12:00:00Z&tz=Europe/Warsaw",
+			"2017-06-01T08:00:00Z", "2017-06-01T12:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		vars, _ := url.ParseQuery(tt.query)
+		from, to, err := parseTimeRange(vars, time.Hour)
+		if err != nil {
+			t.Errorf("parse %q error: %s", tt.query, err)
+			continue
+		}
+		if f := from.UTC().Format(time.RFC3339); f != tt.from {
+			t.Errorf("parse %q: from %v, expected %v", tt.query, f, tt.from)
+		}
+		if to := to.UTC().Format(time.RFC3339); to != tt.to {
+			t.Errorf("parse %q: to %v, expected %v", tt.query, to, tt.to)
+		}
+	}
+
+	vars, _ := url.ParseQuery("from=now-1h")
+	from, to, err := parseTimeRange(vars, 2*time.Hour)
+	if err != nil || to.Sub(from) != time.Hour {
+		t.Errorf("invalid range for relative from: %v - %v, %v", from, to, err)
+	}
+	vars, _ = url.ParseQuery("")
+	if from, to, err = parseTimeRange(vars, 2*time.Hour); err != nil || to.Sub(from) != 2*time.Hour {
+		t.Errorf("invalid default range: %v - %v, %v", from, to, err)
+	}
+	vars, _ = url.ParseQuery("tz=Mars/Olympus")
+	if _, _, err = parseTimeRange(vars, time.Hour); err == nil {
+		t.Errorf("missing error for invalid time zone")
+	}
+}
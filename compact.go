@@ -0,0 +1,213 @@
+//
+// compact.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/common/log"
+)
+
+// compactTxMaxSize is max size of data copied in one transaction
+const compactTxMaxSize = 64 << 20
+
+// CompactResult report database file size before and after compaction
+type CompactResult struct {
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// Compact copy all data into new file and replace database by it, so space
+// of free pages is returned to OS. Writes are blocked during compaction;
+// running queries are interrupted when file is replaced.
+func (db *DB) Compact() (*CompactResult, error) {
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+
+	res := &CompactResult{}
+	if fi, err := os.Stat(db.dbFilename); err == nil {
+		res.SizeBefore = fi.Size()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(db.dbFilename), filepath.Base(db.dbFilename)+".compact")
+	if err != nil {
+		return nil, err
+	}
+	tmpname := f.Name()
+	f.Close()
+	defer os.Remove(tmpname)
+
+	dst, err := bolt.Open(tmpname, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.view(func(tx *bolt.Tx) error {
+		return compactTx(dst, tx)
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db.lockSwap()
+	err = db.replaceFile(tmpname)
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(db.dbFilename); err == nil {
+		res.SizeAfter = fi.Size()
+	}
+	return res, nil
+}
+
+// FreePageRatio return part of database file occupied by free and pending
+// (freed by last write) pages. Bolt update statistics after each write
+// transaction, so result is 0 until first write.
+func (db *DB) FreePageRatio() float64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.db == nil {
+		return 0
+	}
+	fi, err := os.Stat(db.dbFilename)
+	if err != nil || fi.Size() == 0 {
+		return 0
+	}
+	pages := fi.Size() / int64(db.db.Info().PageSize)
+	stats := db.db.Stats()
+	return float64(stats.FreePageN+stats.PendingPageN) / float64(pages)
+}
+
+// compactTx copy all buckets from `src` transaction into `dst` database;
+// data is committed every compactTxMaxSize bytes
+func compactTx(dst *bolt.DB, src *bolt.Tx) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// rollback not committed transaction
+		tx.Rollback()
+	}()
+
+	var size int
+	err = walkBuckets(src, func(path [][]byte, k, v []byte, seq uint64) error {
+		if size += len(k) + len(v); size > compactTxMaxSize {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = dst.Begin(true); err != nil {
+				return err
+			}
+			size = 0
+		}
+
+		// keys are inserted in order, so pages may be filled completely
+		if len(path) == 0 {
+			b, err := tx.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			b.FillPercent = 1.0
+			return b.SetSequence(seq)
+		}
+
+		b := tx.Bucket(path[0])
+		b.FillPercent = 1.0
+		for _, name := range path[1:] {
+			b = b.Bucket(name)
+			b.FillPercent = 1.0
+		}
+		if v == nil {
+			nb, err := b.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			nb.FillPercent = 1.0
+			return nb.SetSequence(seq)
+		}
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// walkBuckets call `fn` for every bucket and key in `tx`. For buckets `v`
+// is nil and `seq` is bucket sequence; `path` is list of parent buckets.
+func walkBuckets(tx *bolt.Tx, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if err := fn(nil, name, nil, b.Sequence()); err != nil {
+			return err
+		}
+		return walkBucket(b, [][]byte{name}, fn)
+	})
+}
+
+func walkBucket(b *bolt.Bucket, path [][]byte, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return fn(path, k, v, 0)
+		}
+		nb := b.Bucket(k)
+		if err := fn(path, k, nil, nb.Sequence()); err != nil {
+			return err
+		}
+		return walkBucket(nb, append(path[:len(path):len(path)], k), fn)
+	})
+}
+
+// compactHandler run compaction on request; require admin token
+type compactHandler struct {
+	Configuration *Configuration
+	DB            *DB
+}
+
+func (h *compactHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "compactHandler.onPost")
+
+	if status := h.Configuration.authorizeAdmin(r); status != http.StatusOK {
+		l.Infof("compact unauthorized")
+		return status, http.StatusText(status)
+	}
+
+	l.Infof("start compaction")
+	res, err := h.DB.Compact()
+	if err != nil {
+		l.Errorf("compact error: %s", err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+	l.Infof("compaction finished; size %d -> %d", res.SizeBefore, res.SizeAfter)
+	return http.StatusOK, res
+}
+
+func (h compactHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch r.Method {
+	case "POST":
+		code, data = h.onPost(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
@@ -0,0 +1,88 @@
+//
+// compact_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCompact(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	text := strings.Repeat("some long event text ", 50)
+	var events []*Event
+	for i := 0; i < 2000; i++ {
+		events = append(events, &Event{
+			Name:  "test",
+			Title: "event",
+			Text:  text,
+			Tags:  []string{"t1"},
+			Time:  int64(i+1) * int64(time.Second),
+		})
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+	if _, err := db.DeleteEvents(time.Unix(0, 0), time.Unix(1500, 0), "test"); err != nil {
+		t.Fatalf("delete events error: %s", err)
+	}
+
+	if ratio := db.FreePageRatio(); ratio <= 0.5 {
+		t.Errorf("expected many free pages, got ratio %0.2f", ratio)
+	}
+
+	res, err := db.Compact()
+	if err != nil {
+		t.Fatalf("compact error: %s", err)
+	}
+	if res.SizeAfter >= res.SizeBefore/2 {
+		t.Errorf("expected smaller file, size %d -> %d", res.SizeBefore, res.SizeAfter)
+	}
+	// pages of compacted database are filled; file size is rounded by
+	// bolt, so check also size of used pages
+	var dataSize, usedSize int64
+	db.view(func(tx *bolt.Tx) error {
+		usedSize = tx.Size()
+		return walkBuckets(tx, func(path [][]byte, k, v []byte, seq uint64) error {
+			dataSize += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	if usedSize > dataSize*3/2 || res.SizeAfter > dataSize*2 {
+		t.Errorf("compacted database too big: %d (file %d) for %d bytes of data",
+			usedSize, res.SizeAfter, dataSize)
+	}
+
+	// events and indexes are copied
+	kept := events[1500:]
+	if _, err := db.GetEvent(kept[0].ID); err != nil {
+		t.Errorf("get event error: %s", err)
+	}
+	tags, _ := ParseTagExpr("t1")
+	found, _, err := db.GetEvents(Query{
+		From: time.Unix(0, 0),
+		To:   time.Unix(3000, 0),
+		Name: AnyBucket,
+		Tags: tags,
+	})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(found) != len(kept) {
+		t.Errorf("expected %d events, got %d", len(kept), len(found))
+	}
+
+	if err := db.SaveEvent(&Event{Name: "test", Time: 1}); err != nil {
+		t.Errorf("save event after compaction error: %s", err)
+	}
+}
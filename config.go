@@ -7,20 +7,52 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net/http"
+	"strings"
 	"time"
 )
 
 type (
 	// Configuration keep application configuration
 	Configuration struct {
-		DBFile    string `yaml:"dbfile"`
-		Retention string `yaml:"retention"`
-		Debug     bool   `yaml:"debug"`
+		DBFile string `yaml:"dbfile"`
+		// Storage select events storage: bolt (default), sqlite or memory
+		Storage string `yaml:"storage"`
+		// SQLiteFile is database file used by sqlite storage
+		SQLiteFile string `yaml:"sqlite_file"`
+		Retention  string `yaml:"retention"`
+		// RetentionRules override global retention for matching events
+		RetentionRules []RetentionRule `yaml:"retention_rules"`
+		Debug          bool            `yaml:"debug"`
+		// VacuumInterval is time between removing expired events
+		VacuumInterval string `yaml:"vacuum_interval"`
+		// CompactThreshold is ratio of free pages to all pages in database
+		// file that trigger compaction after vacuum; 0 disable it
+		CompactThreshold float64 `yaml:"compact_threshold"`
+		// AdminToken authorize administrative requests (ie. restore);
+		// when empty these requests are disabled
+		AdminToken string `yaml:"admin_token"`
 
-		RetentionParsed *time.Duration `yaml:"-"`
+		Snapshot SnapshotConf `yaml:"snapshot"`
+
+		RetentionParsed      *time.Duration `yaml:"-"`
+		VacuumIntervalParsed time.Duration  `yaml:"-"`
+	}
+
+	// SnapshotConf configure periodic snapshots of database
+	SnapshotConf struct {
+		// Dir where snapshots are written; snapshots are disabled when empty
+		Dir      string `yaml:"dir"`
+		Interval string `yaml:"interval"`
+		// Keep is number of snapshots to keep
+		Keep     int  `yaml:"keep"`
+		Compress bool `yaml:"compress"`
+
+		IntervalParsed time.Duration `yaml:"-"`
 	}
 )
 
@@ -28,6 +60,58 @@ func (c *Configuration) validate() error {
 	if c.DBFile == "" {
 		c.DBFile = "eventdb.boltdb"
 	}
+	if c.SQLiteFile == "" {
+		c.SQLiteFile = "eventdb.sqlite"
+	}
+	switch c.Storage {
+	case "":
+		c.Storage = "bolt"
+	case "bolt", "sqlite", "memory":
+	default:
+		return fmt.Errorf("unknown storage '%s'", c.Storage)
+	}
+	if c.VacuumInterval == "" {
+		c.VacuumInterval = "3h"
+	}
+	i, err := parseDuration(c.VacuumInterval)
+	if err != nil {
+		return fmt.Errorf("parse vacuum interval error: %s", err.Error())
+	}
+	if i <= 0 {
+		return fmt.Errorf("invalid vacuum interval")
+	}
+	c.VacuumIntervalParsed = i
+
+	if c.CompactThreshold < 0 || c.CompactThreshold >= 1 {
+		return fmt.Errorf("invalid compact threshold")
+	}
+
+	for i := range c.RetentionRules {
+		if err := c.RetentionRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	return c.Snapshot.validate()
+}
+
+func (s *SnapshotConf) validate() error {
+	if s.Interval == "" {
+		s.Interval = "24h"
+	}
+	i, err := parseDuration(s.Interval)
+	if err != nil {
+		return fmt.Errorf("parse snapshot interval error: %s", err.Error())
+	}
+	if i <= 0 {
+		return fmt.Errorf("invalid snapshot interval")
+	}
+	s.IntervalParsed = i
+	if s.Keep < 0 {
+		return fmt.Errorf("invalid number of snapshots to keep")
+	}
+	if s.Keep == 0 {
+		s.Keep = 7
+	}
 	return nil
 }
 
@@ -49,7 +133,7 @@ func LoadConfiguration(filename string) (*Configuration, error) {
 	}
 
 	if c.Retention != "" {
-		r, err := time.ParseDuration(c.Retention)
+		r, err := parseDuration(c.Retention)
 		if err != nil {
 			return nil, fmt.Errorf("parse retention time error: %s", err.Error())
 		}
@@ -58,3 +142,20 @@ func LoadConfiguration(filename string) (*Configuration, error) {
 
 	return c, nil
 }
+
+// authorizeAdmin check if request `r` carry valid admin token in
+// Authorization header (`Bearer <token>`); return http status
+func (c *Configuration) authorizeAdmin(r *http.Request) int {
+	if c.AdminToken == "" {
+		return http.StatusForbidden
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) != 1 {
+		return http.StatusUnauthorized
+	}
+	return http.StatusOK
+}
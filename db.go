@@ -4,15 +4,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/boltdb/boltd"
 	p "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -20,16 +26,55 @@ type (
 	// DB represent bolt database
 	DB struct {
 		dbFilename string
-		db         *bolt.DB
-		stats      bolt.Stats
-		statsDiff  bolt.Stats
+		// mu guard db and writer; write lock is taken only when database
+		// file is replaced
+		mu sync.RWMutex
+		// wmu is read-locked by writes; write lock block all writes (but
+		// not reads) ie. during compaction; must be taken before mu
+		wmu       sync.RWMutex
+		db        *bolt.DB
+		writer    *batchWriter
+		stats     bolt.Stats
+		statsDiff bolt.Stats
+
+		// imu guard iters and swapping
+		imu sync.Mutex
+		// iters keep cancel functions of running iterations; they are
+		// cancelled before database file is replaced so slow readers don't
+		// block restore and compaction
+		iters    map[uint64]context.CancelFunc
+		iterSeq  uint64
+		swapping bool
 
 		metrics *boltMetrics
 	}
 )
 
+// ErrDBReplaced when query is interrupted because database file is replaced
+var ErrDBReplaced = errors.New("database replaced during query")
+
 // DBOpen open or create bolt database
 func DBOpen(filename string) (*DB, error) {
+	bdb, err := openBolt(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dbFilename: filename,
+		db:         bdb,
+		writer:     newBatchWriter(bdb),
+		stats:      bdb.Stats(),
+	}
+	db.metrics = newBoltMetrics(db)
+	p.MustRegister(db.metrics)
+
+	return db, nil
+}
+
+// openBolt open bolt database, create default bucket, upgrade events and
+// build missing indexes
+func openBolt(filename string) (*bolt.DB, error) {
 	bdb, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 10 * time.Second})
 	if err != nil {
 		return nil, err
@@ -39,42 +84,261 @@ func DBOpen(filename string) (*DB, error) {
 		if _, err := tx.CreateBucketIfNotExists(defaultBucket); err != nil {
 			return fmt.Errorf("db create bucket error: %s", err.Error())
 		}
+		upgraded, err := upgradeEvents(tx)
+		if err != nil {
+			return fmt.Errorf("db upgrade events error: %s", err.Error())
+		}
+		if upgraded > 0 {
+			log.Infof("upgraded %d events to version %d", upgraded, eventVersion)
+		}
+		created, err := createIndexes(tx)
+		if err != nil {
+			return fmt.Errorf("db create indexes error: %s", err.Error())
+		}
+		if created {
+			indexed, err := rebuildIndexes(tx)
+			if err != nil {
+				return fmt.Errorf("db rebuild indexes error: %s", err.Error())
+			}
+			log.Infof("indexed %d events", indexed)
+		}
 		return nil
 	})
 	if err != nil {
 		bdb.Close()
 		return nil, err
 	}
-
-	db := &DB{
-		dbFilename: filename,
-		db:         bdb,
-		metrics:    newBoltMetrics(bdb),
-		stats:      bdb.Stats(),
-	}
-	p.MustRegister(db.metrics)
-
-	return db, nil
+	return bdb, nil
 }
 
 // Close database
 func (db *DB) Close() error {
+	db.lockSwap()
+	defer db.mu.Unlock()
+
 	if db.db != nil {
 		p.Unregister(db.metrics)
-		db.metrics = nil
+		db.writer.close()
 		db.db.Close()
 		db.db = nil
 	}
 	return nil
 }
 
+// view run read-only transaction on current database
+func (db *DB) view(fn func(tx *bolt.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.db == nil {
+		return ErrDBClosed
+	}
+	return db.db.View(fn)
+}
+
+// startIteration register long-running read; returned context is cancelled
+// when database file is going to be replaced. Must be called in view and
+// returned function must be called when iteration finish.
+func (db *DB) startIteration(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	db.imu.Lock()
+	defer db.imu.Unlock()
+
+	if db.swapping {
+		// read lock was taken just before swap started
+		cancel()
+		return ctx, cancel
+	}
+	if db.iters == nil {
+		db.iters = make(map[uint64]context.CancelFunc)
+	}
+	db.iterSeq++
+	id := db.iterSeq
+	db.iters[id] = cancel
+
+	return ctx, func() {
+		db.imu.Lock()
+		delete(db.iters, id)
+		db.imu.Unlock()
+		cancel()
+	}
+}
+
+// lockSwap cancel running iterations and take write lock on database
+func (db *DB) lockSwap() {
+	db.imu.Lock()
+	db.swapping = true
+	for _, cancel := range db.iters {
+		cancel()
+	}
+	db.imu.Unlock()
+
+	db.mu.Lock()
+
+	db.imu.Lock()
+	db.swapping = false
+	db.imu.Unlock()
+}
+
+// update run `fn` in own write transaction on current database
+func (db *DB) update(fn func(tx *bolt.Tx) error) error {
+	db.wmu.RLock()
+	defer db.wmu.RUnlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.db == nil {
+		return ErrDBClosed
+	}
+	return db.db.Update(fn)
+}
+
+// write run `fn` in write transaction shared with other concurrent writes;
+// see batchWriter.update
+func (db *DB) write(fn func(tx *bolt.Tx) error) error {
+	db.wmu.RLock()
+	defer db.wmu.RUnlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.writer.update(fn)
+}
+
+// RebuildIndexes drop and create again all indexes
+func (db *DB) RebuildIndexes() (int, error) {
+	var indexed int
+	err := db.update(func(tx *bolt.Tx) error {
+		var err error
+		indexed, err = rebuildIndexes(tx)
+		return err
+	})
+	return indexed, err
+}
+
+// Restore replace database by one read from `r`. Data is validated and
+// prepared (upgraded, indexed) in temporary file before swap, so database
+// is blocked only for time of reopening. Running queries are interrupted
+// with ErrDBReplaced.
+func (db *DB) Restore(r io.Reader) error {
+	tmpname, err := prepareRestore(r, db.dbFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+
+	db.wmu.Lock()
+	defer db.wmu.Unlock()
+	db.lockSwap()
+	defer db.mu.Unlock()
+
+	return db.replaceFile(tmpname)
+}
+
+// replaceFile close database, replace its file by `filename` and open it
+// again. Caller must hold write lock.
+func (db *DB) replaceFile(filename string) error {
+	if db.db == nil {
+		return ErrDBClosed
+	}
+
+	db.writer.close()
+	db.db.Close()
+
+	// on rename error reopen previous database
+	err := os.Rename(filename, db.dbFilename)
+
+	bdb, oerr := openBolt(db.dbFilename)
+	if oerr != nil {
+		db.db = nil
+		return fmt.Errorf("reopen database error: %s", oerr.Error())
+	}
+	db.db = bdb
+	db.writer = newBatchWriter(bdb)
+	db.stats = bdb.Stats()
+	return err
+}
+
+// prepareRestore copy database (optionally gzipped) from `r` into temporary
+// file placed next to `dbFilename`, validate and upgrade it. Return name of
+// temporary file.
+func prepareRestore(r io.Reader, dbFilename string) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(dbFilename), filepath.Base(dbFilename)+".restore")
+	if err != nil {
+		return "", err
+	}
+	tmpname := f.Name()
+
+	if r, err = maybeGunzip(r); err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = validateDBFile(tmpname)
+	}
+	if err == nil {
+		var bdb *bolt.DB
+		if bdb, err = openBolt(tmpname); err == nil {
+			err = bdb.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return "", err
+	}
+	return tmpname, nil
+}
+
+// invalidDBError is returned when restored file is not valid eventdb database
+type invalidDBError string
+
+func (e invalidDBError) Error() string {
+	return "invalid database: " + string(e)
+}
+
+// validateDBFile check if `filename` is bolt database created by eventdb
+func validateDBFile(filename string) error {
+	if fi, err := os.Stat(filename); err != nil {
+		return err
+	} else if fi.Size() == 0 {
+		return invalidDBError("empty file")
+	}
+
+	bdb, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return invalidDBError(err.Error())
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(defaultBucket) == nil {
+			return invalidDBError(fmt.Sprintf("missing %s bucket", defaultBucket))
+		}
+		return forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if v == nil || len(k) != eventKeyLen {
+					return invalidDBError(fmt.Sprintf("unexpected key %v in bucket %s", k, name))
+				}
+				e := &Event{}
+				if err := e.unmarshal(v); err != nil {
+					return invalidDBError(fmt.Sprintf("event %v in bucket %s: %s", k, name, err))
+				}
+			}
+			return nil
+		})
+	})
+}
+
 // NewInternalsHandler create http handlers related to database
 func (db *DB) NewInternalsHandler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/backup", db.backupHandler)
 	mux.HandleFunc("/stats", db.statsHandler)
 	// Tests
-	mux.Handle("/introspection/", http.StripPrefix("/introspection", boltd.NewHandler(db.db)))
+	mux.Handle("/introspection/", http.StripPrefix("/introspection", http.HandlerFunc(db.introspectionHandler)))
 	return mux
 }
 
@@ -83,7 +347,7 @@ func (db *DB) backupHandler(w http.ResponseWriter, r *http.Request) {
 		With("action", "db.backupHandler")
 
 	l.Debugf("start backup")
-	err := db.db.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Header().Set("Content-Disposition", `attachment; filename="`+db.dbFilename+`"`)
 		w.Header().Set("Content-Length", strconv.Itoa(int(tx.Size())))
@@ -97,11 +361,74 @@ func (db *DB) backupHandler(w http.ResponseWriter, r *http.Request) {
 	l.Debugf("backup finished")
 }
 
+// restoreHandler replace database by uploaded backup; require admin token
+type restoreHandler struct {
+	Configuration *Configuration
+	DB            *DB
+}
+
+func (h restoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI).
+		With("action", "db.restoreHandler")
+
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if status := h.Configuration.authorizeAdmin(r); status != http.StatusOK {
+		l.Infof("restore unauthorized")
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if mr, err := r.MultipartReader(); err == nil {
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, "missing file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer part.Close()
+		body = part
+	}
+
+	l.Infof("start restore")
+	if err := h.DB.Restore(body); err != nil {
+		l.Errorf("restore error: %s", err.Error())
+		status := http.StatusInternalServerError
+		if _, ok := err.(invalidDBError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	l.Infof("restore finished")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (db *DB) introspectionHandler(w http.ResponseWriter, r *http.Request) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.db == nil {
+		http.Error(w, ErrDBClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	boltd.NewHandler(db.db).ServeHTTP(w, r)
+}
+
 func (db *DB) statsHandler(w http.ResponseWriter, r *http.Request) {
 	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI).
 		With("action", "db.statsHandler")
 	l.Debugf("get stats")
+	db.mu.RLock()
+	if db.db == nil {
+		db.mu.RUnlock()
+		http.Error(w, ErrDBClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	stats := db.db.Stats()
+	db.mu.RUnlock()
 	db.statsDiff = db.stats.Sub(&db.stats)
 	db.stats = stats
 	w.Header().Set("Content-Type", "application/json")
@@ -146,10 +473,10 @@ type boltMetrics struct {
 	bucketInlineBucketInuse *p.Desc
 	bucketSequence          *p.Desc
 
-	db *bolt.DB
+	db *DB
 }
 
-func newBoltMetrics(db *bolt.DB) *boltMetrics {
+func newBoltMetrics(db *DB) *boltMetrics {
 	bucketLabels := []string{"bucket"}
 
 	return &boltMetrics{
@@ -234,16 +561,20 @@ func (m *boltMetrics) Describe(ch chan<- *p.Desc) {
 }
 
 func (m *boltMetrics) Collect(ch chan<- p.Metric) {
-	if m.db == nil {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	bdb := m.db.db
+	if bdb == nil {
 		return
 	}
-	ch <- p.MustNewConstMetric(m.instance, p.GaugeValue, float64(1), m.db.Path())
+	ch <- p.MustNewConstMetric(m.instance, p.GaugeValue, float64(1), bdb.Path())
 
-	if stat, err := os.Lstat(m.db.Path()); err == nil {
+	if stat, err := os.Lstat(bdb.Path()); err == nil {
 		ch <- p.MustNewConstMetric(m.fileSize, p.GaugeValue, float64(stat.Size()))
 	}
 
-	stats := m.db.Stats()
+	stats := bdb.Stats()
 	ch <- p.MustNewConstMetric(m.freePageN, p.CounterValue, float64(stats.FreePageN))
 	ch <- p.MustNewConstMetric(m.pendigPageN, p.CounterValue, float64(stats.PendingPageN))
 	ch <- p.MustNewConstMetric(m.freeAlloc, p.CounterValue, float64(stats.FreeAlloc))
@@ -263,7 +594,7 @@ func (m *boltMetrics) Collect(ch chan<- p.Metric) {
 	ch <- p.MustNewConstMetric(m.write, p.CounterValue, float64(stats.TxStats.Write))
 	ch <- p.MustNewConstMetric(m.writeTime, p.CounterValue, float64(stats.TxStats.WriteTime))
 
-	m.db.View(func(tx *bolt.Tx) error {
+	bdb.View(func(tx *bolt.Tx) error {
 		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
 			stats := b.Stats()
 			bucket := string(name)
@@ -0,0 +1,808 @@
+//
+// db_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func openTestDB(t testing.TB) (*DB, func()) {
+	dir, err := ioutil.TempDir("", "eventdb")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	db, err := DBOpen(filepath.Join(dir, "test.boltdb"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("open db error: %s", err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testEventByID(t *testing.T, db EventStore) {
+	now := time.Now()
+	e := &Event{
+		Name:  "test",
+		Title: "title",
+		Time:  now.UnixNano(),
+		Text:  "text",
+		Tags:  []string{"t1", "t2"},
+	}
+	if err := db.SaveEvent(e); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+	if e.ID == "" {
+		t.Fatalf("missing event id")
+	}
+
+	e2, err := db.GetEvent(e.ID)
+	if err != nil {
+		t.Fatalf("get event error: %s", err)
+	}
+	eventsCompare(e, e2, t)
+
+	e3, err := db.UpdateEvent(e.ID, func(ev *Event) error {
+		ev.Title = "new title"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update event error: %s", err)
+	}
+	if e3.ID != e.ID || e3.Title != "new title" || e3.Text != e.Text {
+		t.Fatalf("invalid updated event: %+v", e3)
+	}
+
+	events, _, err := db.GetEvents(Query{From: now.Add(-time.Minute), To: now.Add(time.Minute), Name: "test"})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("invalid number of events after update: %+v", events)
+	}
+	eventsCompare(e3, events[0], t)
+
+	if err := db.DeleteEvent(e.ID); err != nil {
+		t.Fatalf("delete event error: %s", err)
+	}
+	if _, err := db.GetEvent(e.ID); err != ErrEventNotFound {
+		t.Fatalf("event not deleted: %v", err)
+	}
+	if err := db.DeleteEvent(e.ID); err != ErrEventNotFound {
+		t.Fatalf("invalid error on deleting not existing event: %v", err)
+	}
+}
+
+func testGetEventsOverlap(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{Name: "test", Title: "point", Time: base.UnixNano()},
+		{Name: "test", Title: "region", Time: base.Add(time.Hour).UnixNano(),
+			TimeEnd: base.Add(5 * time.Hour).UnixNano()},
+		{Name: "test", Title: "late", Time: base.Add(10 * time.Hour).UnixNano()},
+	}
+	for _, e := range events {
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	res, _, err := db.GetEvents(Query{From: base.Add(2 * time.Hour), To: base.Add(3 * time.Hour), Name: "test"})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(res) != 1 || res[0].Title != "region" {
+		t.Fatalf("invalid events: %+v", res)
+	}
+
+	res, _, err = db.GetEvents(Query{From: base.Add(4 * time.Hour), To: base.Add(11 * time.Hour), Name: AnyBucket})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(res) != 2 || res[0].Title != "region" || res[1].Title != "late" {
+		t.Fatalf("invalid events: %+v", res)
+	}
+
+	// span of region events is not subtracted below zero time
+	for _, name := range []string{"test", AnyBucket} {
+		res, _, err = db.GetEvents(Query{From: time.Unix(0, 0), To: base.Add(11 * time.Hour), Name: name})
+		if err != nil {
+			t.Fatalf("get events error: %s", err)
+		}
+		if len(res) != 3 {
+			t.Fatalf("invalid events from zero time in %s: %+v", name, res)
+		}
+	}
+}
+
+func testUpsertEvent(t *testing.T, db EventStore) {
+	now := time.Now()
+	ref := []byte("ref1")
+
+	e := &Event{Name: "alerts", Title: "[firing]", Time: now.UnixNano()}
+	created, err := db.UpsertEvent(ref, e)
+	if err != nil || !created {
+		t.Fatalf("upsert error: %v, created: %v", err, created)
+	}
+	id := e.ID
+
+	e2 := &Event{Name: "alerts", Title: "[resolved]", Time: now.UnixNano(),
+		TimeEnd: now.Add(time.Minute).UnixNano()}
+	created, err = db.UpsertEvent(ref, e2)
+	if err != nil || created {
+		t.Fatalf("upsert error: %v, created: %v", err, created)
+	}
+	if e2.ID != id {
+		t.Fatalf("event id changed: %v -> %v", id, e2.ID)
+	}
+
+	events, _, err := db.GetEvents(Query{From: now.Add(-time.Hour), To: now.Add(time.Hour), Name: "alerts"})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("invalid number of events: %+v", events)
+	}
+	eventsCompare(e2, events[0], t)
+
+	// deleted event should be created again
+	if err := db.DeleteEvent(id); err != nil {
+		t.Fatalf("delete event error: %s", err)
+	}
+	created, err = db.UpsertEvent(ref, e2)
+	if err != nil || !created || e2.ID == id {
+		t.Fatalf("upsert error: %v, created: %v, id: %v", err, created, e2.ID)
+	}
+}
+
+func testGetEventsByTags(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		e := &Event{
+			Name:  "b" + strconv.Itoa(i%3),
+			Title: strconv.Itoa(i),
+			Time:  base.Add(time.Duration(i) * time.Minute).UnixNano(),
+		}
+		e.SetTags("all t" + strconv.Itoa(i%5))
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	from, to := base, base.Add(time.Hour)
+	check := func(name string, query string, expected int) []*Event {
+		tags, err := ParseTagExpr(query)
+		if err != nil {
+			t.Fatalf("parse tags %q error: %s", query, err)
+		}
+		events, _, err := db.GetEvents(Query{From: from, To: to, Name: name, Tags: tags})
+		if err != nil {
+			t.Fatalf("get events error: %s", err)
+		}
+		if len(events) != expected {
+			t.Fatalf("invalid number of events for %s %v: %d != %d", name, tags, len(events), expected)
+		}
+		for i, e := range events {
+			if !tags.Match(e.Tags) {
+				t.Fatalf("invalid event tags: %+v", e)
+			}
+			if i > 0 && events[i-1].Time > e.Time {
+				t.Fatalf("events not sorted: %+v", events)
+			}
+		}
+		return events
+	}
+
+	check(AnyBucket, "t1", 12)
+	check("b1", "t1", 4)
+	check(AnyBucket, "all t2", 12)
+	check(AnyBucket, "t1 AND t2", 0)
+	check(AnyBucket, "t1 OR t2", 24)
+	check(AnyBucket, "all AND NOT (t1 OR t2)", 37)
+	check("b0", "NOT t1", 17)
+
+	// delete should remove events from index
+	if _, err := db.DeleteEvents(base, base.Add(30*time.Minute), AnyBucket); err != nil {
+		t.Fatalf("delete events error: %s", err)
+	}
+	check(AnyBucket, "t1", 6)
+
+	if bdb, ok := db.(*DB); ok {
+		if _, err := bdb.RebuildIndexes(); err != nil {
+			t.Fatalf("rebuild indexes error: %s", err)
+		}
+		check(AnyBucket, "t1", 6)
+	}
+	check("b1", "all", 10)
+}
+
+func testGetEventsByText(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{Name: "alerts", Title: "Disk full on db-primary-3", Text: "restarting", Tags: []string{"prod"}},
+		{Name: "alerts", Title: "Disk full on db-primary-4", Text: "restarted", Tags: []string{"prod"}},
+		{Name: "deploy", Title: "Deploy db-primary-3", Text: "new version", Tags: []string{"stage"}},
+		{Name: "deploy", Title: "Deploy web", Text: "full deploy of db-primary-3"},
+	}
+	for i, e := range events {
+		e.Time = base.Add(time.Duration(i) * time.Minute).UnixNano()
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	check := func(name, tags, text string, expected ...int) {
+		expr, _ := ParseTagExpr(tags)
+		res, _, err := db.GetEvents(Query{From: base, To: base.Add(time.Hour), Name: name, Tags: expr, Text: text})
+		if err != nil {
+			t.Fatalf("get events error: %s", err)
+		}
+		if len(res) != len(expected) {
+			t.Fatalf("invalid result for %s/%s/%s: %+v", name, tags, text, res)
+		}
+		for i, idx := range expected {
+			if res[i].ID != events[idx].ID {
+				t.Fatalf("invalid result for %s/%s/%s: %+v", name, tags, text, res)
+			}
+		}
+	}
+
+	check(AnyBucket, "", "db-primary-3", 0, 2, 3)
+	check(AnyBucket, "", "restart*", 0, 1)
+	check(AnyBucket, "", `"disk full"`, 0, 1)
+	check(AnyBucket, "", "full", 0, 1, 3)
+	check("deploy", "", "db-primary-3", 2, 3)
+	check(AnyBucket, "prod", "db-primary-3", 0)
+	check(AnyBucket, "NOT prod", "db-primary-3", 2, 3)
+	check(AnyBucket, "", "nothing", []int{}...)
+}
+
+func testGetEventsPages(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		e := &Event{
+			Name:  "b" + strconv.Itoa(i%4),
+			Title: strconv.Itoa(i),
+			// some events with the same time
+			Time: base.Add(time.Duration(i/2) * time.Minute).UnixNano(),
+		}
+		e.SetTags("all t" + strconv.Itoa(i%3))
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	for _, tags := range []string{"", "all", "t1 OR t2"} {
+		for _, order := range []string{OrderAsc, OrderDesc} {
+			expr, _ := ParseTagExpr(tags)
+			q := Query{From: base, To: base.Add(time.Hour), Name: AnyBucket,
+				Tags: expr, Order: order}
+
+			all, next, err := db.GetEvents(q)
+			if err != nil || next != "" {
+				t.Fatalf("get events error: %v, next: %q", err, next)
+			}
+			for i := 1; i < len(all); i++ {
+				if (order == OrderAsc && all[i-1].Time > all[i].Time) ||
+					(order == OrderDesc && all[i-1].Time < all[i].Time) {
+					t.Fatalf("invalid order %s/%s: %+v", tags, order, all)
+				}
+			}
+
+			q.Limit = 7
+			var paged []*Event
+			for {
+				events, next, err := db.GetEvents(q)
+				if err != nil {
+					t.Fatalf("get events error: %s", err)
+				}
+				if len(events) > q.Limit {
+					t.Fatalf("too many events: %d", len(events))
+				}
+				paged = append(paged, events...)
+				if next == "" {
+					break
+				}
+				q.Cursor = next
+			}
+
+			if len(paged) != len(all) {
+				t.Fatalf("invalid number of events %s/%s: %d != %d", tags, order, len(paged), len(all))
+			}
+			for i, e := range paged {
+				if e.ID != all[i].ID {
+					t.Fatalf("invalid event %d %s/%s: %+v != %+v", i, tags, order, e, all[i])
+				}
+			}
+		}
+	}
+
+	if _, _, err := db.GetEvents(Query{To: base, Cursor: "!"}); err != ErrInvalidCursor {
+		t.Fatalf("invalid error for wrong cursor: %v", err)
+	}
+	if _, _, err := db.GetEvents(Query{To: base, Order: "x"}); err != ErrInvalidOrder {
+		t.Fatalf("invalid error for wrong order: %v", err)
+	}
+}
+
+func testIterEvents(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		e := &Event{
+			Name:  "b" + strconv.Itoa(i%3),
+			Title: strconv.Itoa(i),
+			Time:  base.Add(time.Duration(i) * time.Minute).UnixNano(),
+		}
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	q := Query{From: base, To: base.Add(time.Hour), Name: AnyBucket}
+
+	var titles []string
+	_, err := db.IterEvents(context.Background(), q, func(e *Event) error {
+		titles = append(titles, e.Title)
+		if len(titles) == 4 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iter events error: %s", err)
+	}
+	if strings.Join(titles, ",") != "0,1,2,3" {
+		t.Fatalf("invalid events: %v", titles)
+	}
+
+	errTest := errors.New("test")
+	if _, err := db.IterEvents(context.Background(), q, func(e *Event) error {
+		return errTest
+	}); err != errTest {
+		t.Fatalf("invalid error from callback: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cnt := 0
+	_, err = db.IterEvents(ctx, q, func(e *Event) error {
+		cnt++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || cnt != 1 {
+		t.Fatalf("invalid result for canceled context: %v, %d", err, cnt)
+	}
+}
+
+func testGetHistogram(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		e := &Event{
+			Name: "b" + strconv.Itoa(i%2),
+			Time: base.Add(time.Duration(i) * 30 * time.Minute).UnixNano(),
+		}
+		if i%3 == 0 {
+			e.SetTags("deploy")
+		} else {
+			e.SetTags("alert prod")
+		}
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	check := func(q HistogramQuery, expected map[string]string) {
+		q.From, q.To, q.Step = base, base.Add(6*time.Hour), 2*time.Hour
+		h, err := db.GetHistogram(q)
+		if err != nil {
+			t.Fatalf("get histogram %+v error: %s", q, err)
+		}
+		res := make(map[string]string)
+		for _, s := range h.Series {
+			res[s.Group] = fmt.Sprint(s.Counts)
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("invalid histogram for %+v: %v, expected %v", q, res, expected)
+		}
+	}
+
+	check(HistogramQuery{Name: AnyBucket}, map[string]string{"": "[4 4 4]"})
+	check(HistogramQuery{Name: "b1"}, map[string]string{"": "[2 2 2]"})
+	check(HistogramQuery{Name: "bx"}, map[string]string{"": "[0 0 0]"})
+	check(HistogramQuery{Name: AnyBucket, GroupBy: GroupByName},
+		map[string]string{"b0": "[2 2 2]", "b1": "[2 2 2]"})
+	check(HistogramQuery{Name: AnyBucket, GroupBy: GroupByTag},
+		map[string]string{"deploy": "[2 1 1]", "alert": "[2 3 3]", "prod": "[2 3 3]"})
+	expr, _ := ParseTagExpr("NOT deploy")
+	check(HistogramQuery{Name: "b0", Tags: expr, GroupBy: GroupByTag},
+		map[string]string{"alert": "[1 1 2]", "prod": "[1 1 2]"})
+
+	if _, err := db.GetHistogram(HistogramQuery{To: base, GroupBy: "x", Step: time.Hour}); err != ErrInvalidGroupBy {
+		t.Errorf("invalid error for wrong group by: %v", err)
+	}
+	if _, err := db.GetHistogram(HistogramQuery{To: base, Step: 0}); err != ErrInvalidStep {
+		t.Errorf("invalid error for wrong step: %v", err)
+	}
+	// range wider than max time.Duration
+	wide := HistogramQuery{From: time.Unix(0, 0), To: time.Unix(99999999999, 0), Step: 200 * 365 * 24 * time.Hour}
+	if _, err := db.GetHistogram(wide); err != ErrInvalidStep {
+		t.Errorf("invalid error for too wide range: %v", err)
+	}
+}
+
+func testGetNamesTags(t *testing.T, db EventStore) {
+	for i, name := range []string{"deploy", "alert", "deploy"} {
+		e := &Event{Name: name, Time: int64(i+1) * 1000000000}
+		e.SetTags("t" + strconv.Itoa(i) + " common")
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	names, err := db.GetNames()
+	if err != nil {
+		t.Fatalf("get names error: %s", err)
+	}
+	if strings.Join(names, ",") != "__default__,alert,deploy" {
+		t.Errorf("invalid names: %v", names)
+	}
+
+	tags, err := db.GetTags()
+	if err != nil {
+		t.Fatalf("get tags error: %s", err)
+	}
+	if strings.Join(tags, ",") != "common,t0,t1,t2" {
+		t.Errorf("invalid tags: %v", tags)
+	}
+}
+
+// testStoreSpan return longest event duration kept by store for bucket
+// `bname`; skip test for stores that don't keep it
+func testStoreSpan(t *testing.T, db EventStore, bname string) int64 {
+	var span int64
+	switch s := db.(type) {
+	case *DB:
+		s.view(func(tx *bolt.Tx) error {
+			span = bucketMaxSpan(tx, []byte(bname))
+			return nil
+		})
+	case *SQLiteStore:
+		err := s.db.QueryRow(`SELECT max_span FROM buckets WHERE name = ?`, bname).Scan(&span)
+		if err != nil {
+			t.Fatalf("get span error: %s", err)
+		}
+	default:
+		t.Skip("store don't keep events span")
+	}
+	return span
+}
+
+func testBucketSpan(t *testing.T, db EventStore) {
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	long := &Event{Name: "alerts", Time: now.Add(-5 * week).UnixNano(),
+		TimeEnd: now.Add(-2 * week).UnixNano()}
+	short := &Event{Name: "alerts", Time: now.Add(-time.Hour).UnixNano(),
+		TimeEnd: now.UnixNano()}
+	if err := db.SaveEvents([]*Event{long, short}); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+	if span := testStoreSpan(t, db, "alerts"); span != int64(3*week) {
+		t.Fatalf("invalid span after save: %v", time.Duration(span))
+	}
+
+	// span shrink after deleting longest event
+	if err := db.DeleteEvent(long.ID); err != nil {
+		t.Fatalf("delete event error: %s", err)
+	}
+	if span := testStoreSpan(t, db, "alerts"); span != int64(time.Hour) {
+		t.Errorf("invalid span after delete: %v", time.Duration(span))
+	}
+
+	// ... after shortening it
+	_, err := db.UpdateEvent(short.ID, func(e *Event) error {
+		e.TimeEnd = e.Time + int64(time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update event error: %s", err)
+	}
+	if span := testStoreSpan(t, db, "alerts"); span != int64(time.Minute) {
+		t.Errorf("invalid span after update: %v", time.Duration(span))
+	}
+
+	// ... and after vacuum
+	long.ID = ""
+	if err := db.SaveEvent(long); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+	r := week
+	if _, err := db.Vacuum(&Configuration{RetentionParsed: &r}, now, false); err != nil {
+		t.Fatalf("vacuum error: %s", err)
+	}
+	if span := testStoreSpan(t, db, "alerts"); span != int64(time.Minute) {
+		t.Errorf("invalid span after vacuum: %v", time.Duration(span))
+	}
+
+	// ... and after replacing longest event by upsert
+	ref := []byte("ref1")
+	if _, err := db.UpsertEvent(ref, &Event{Name: "upserts", Time: now.Add(-2 * week).UnixNano(),
+		TimeEnd: now.UnixNano()}); err != nil {
+		t.Fatalf("upsert event error: %s", err)
+	}
+	if _, err := db.UpsertEvent(ref, &Event{Name: "upserts", Time: now.Add(-time.Hour).UnixNano(),
+		TimeEnd: now.UnixNano()}); err != nil {
+		t.Fatalf("upsert event error: %s", err)
+	}
+	if span := testStoreSpan(t, db, "upserts"); span != int64(time.Hour) {
+		t.Errorf("invalid span after upsert: %v", time.Duration(span))
+	}
+}
+
+func TestDeleteEventsPruneRefs(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ref := []byte("ref1")
+	if _, err := db.UpsertEvent(ref, &Event{Name: "alerts", Time: 1000}); err != nil {
+		t.Fatalf("upsert event error: %s", err)
+	}
+	if _, err := db.DeleteEvents(time.Unix(0, 0), time.Unix(1, 0), "alerts"); err != nil {
+		t.Fatalf("delete events error: %s", err)
+	}
+	db.view(func(tx *bolt.Tx) error {
+		if id := indexSubBucket(tx, refIndexBucket).Get(ref); id != nil {
+			t.Errorf("ref to deleted event %s not removed", id)
+		}
+		return nil
+	})
+}
+
+func testSameTimeEvents(t *testing.T, db EventStore) {
+	// events from one alert group often start at the same time
+	var events []*Event
+	for i := 0; i < 200; i++ {
+		events = append(events, &Event{Name: "alerts", Title: fmt.Sprintf("e%d", i), Time: 1000})
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+	for _, e := range events[:100] {
+		if err := db.SaveEvent(&Event{Name: "alerts", Title: e.Title, Time: 1000}); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	all, _, err := db.GetEvents(Query{From: time.Unix(0, 0), To: time.Unix(0, 2000), Name: AnyBucket})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(all) != 300 {
+		t.Errorf("expected 300 events, got %d", len(all))
+	}
+	for _, e := range events {
+		if res, err := db.GetEvent(e.ID); err != nil || res.Title != e.Title {
+			t.Fatalf("invalid event for id %s: expected %s, got %+v, %v", e.ID, e.Title, res, err)
+		}
+	}
+
+	if err := db.DeleteEvent(events[0].ID); err != nil {
+		t.Fatalf("delete event error: %s", err)
+	}
+	if res, err := db.GetEvent(events[1].ID); err != nil || res.Title != events[1].Title {
+		t.Errorf("other event deleted: %+v, %v", res, err)
+	}
+}
+
+func testSaveEventsAtomic(t *testing.T, db EventStore) {
+	events := []*Event{
+		{Name: "b1", Title: "e1", Time: int64(time.Second)},
+		{Name: string(indexBucket), Title: "e2", Time: 2 * int64(time.Second)},
+	}
+	if err := db.SaveEvents(events); err == nil {
+		t.Fatalf("expected error for invalid event name")
+	}
+	all, _, err := db.GetEvents(Query{From: time.Unix(0, 0), To: time.Unix(10, 0), Name: AnyBucket})
+	if err != nil {
+		t.Fatalf("get events error: %s", err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected no events saved, got %+v", all)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	e1 := &Event{Name: "test", Title: "backup", Time: 1000}
+	if err := db.SaveEvent(e1); err != nil {
+		cleanup()
+		t.Fatalf("save event error: %s", err)
+	}
+	var backup bytes.Buffer
+	err := db.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&backup)
+		return err
+	})
+	cleanup()
+	if err != nil {
+		t.Fatalf("backup error: %s", err)
+	}
+
+	db, cleanup = openTestDB(t)
+	defer cleanup()
+
+	e2 := &Event{Name: "test", Title: "current", Time: 2000}
+	if err := db.SaveEvent(e2); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+
+	if err := db.Restore(strings.NewReader("not a database")); err == nil {
+		t.Fatalf("expected error for invalid file")
+	} else if _, ok := err.(invalidDBError); !ok {
+		t.Errorf("expected invalidDBError, got %T %s", err, err)
+	}
+	if _, err := db.GetEvent(e2.ID); err != nil {
+		t.Fatalf("event lost after failed restore: %s", err)
+	}
+
+	if err := db.Restore(&backup); err != nil {
+		t.Fatalf("restore error: %s", err)
+	}
+	if e, err := db.GetEvent(e1.ID); err != nil || e.Title != "backup" {
+		t.Errorf("expected restored event, got %v, %s", e, err)
+	}
+	if _, err := db.GetEvent(e2.ID); err != ErrEventNotFound {
+		t.Errorf("expected event not found after restore, got %s", err)
+	}
+	if err := db.SaveEvent(&Event{Name: "test", Time: 3000}); err != nil {
+		t.Errorf("save event after restore error: %s", err)
+	}
+}
+
+func TestRestoreWithSlowReader(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	var events []*Event
+	for i := 1; i <= 100; i++ {
+		events = append(events, &Event{Name: "test", Time: int64(i)})
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+	var backup bytes.Buffer
+	if err := db.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&backup)
+		return err
+	}); err != nil {
+		t.Fatalf("backup error: %s", err)
+	}
+
+	// reader that need seconds to consume all events
+	started := make(chan struct{})
+	iterErr := make(chan error, 1)
+	go func() {
+		cnt := 0
+		_, err := db.IterEvents(context.Background(), Query{From: time.Unix(0, 0),
+			To: time.Unix(0, 1000), Name: AnyBucket}, func(e *Event) error {
+			if cnt++; cnt == 1 {
+				close(started)
+			}
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		})
+		iterErr <- err
+	}()
+	<-started
+
+	restored := make(chan error, 1)
+	go func() {
+		restored <- db.Restore(&backup)
+	}()
+
+	select {
+	case err := <-restored:
+		if err != nil {
+			t.Fatalf("restore error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("restore blocked by reader")
+	}
+	if err := <-iterErr; err != ErrDBReplaced {
+		t.Errorf("expected ErrDBReplaced for interrupted reader, got %v", err)
+	}
+
+	// new queries work after restore
+	res, _, err := db.GetEvents(Query{From: time.Unix(0, 0), To: time.Unix(0, 1000), Name: AnyBucket})
+	if err != nil || len(res) != len(events) {
+		t.Errorf("invalid events after restore: %d, %v", len(res), err)
+	}
+}
+
+func TestValidateDBFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventdb")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// bolt database not created by eventdb
+	fname := filepath.Join(dir, "other.boltdb")
+	bdb, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatalf("create db error: %s", err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("users"))
+		return err
+	})
+	bdb.Close()
+	if err != nil {
+		t.Fatalf("create bucket error: %s", err)
+	}
+	if err := validateDBFile(fname); err == nil {
+		t.Errorf("expected error for not eventdb database")
+	}
+
+	// default bucket with not event data
+	bdb, err = bolt.Open(fname, 0600, nil)
+	if err != nil {
+		t.Fatalf("open db error: %s", err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(defaultBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("value"))
+	})
+	bdb.Close()
+	if err != nil {
+		t.Fatalf("create bucket error: %s", err)
+	}
+	if err := validateDBFile(fname); err == nil {
+		t.Errorf("expected error for invalid events")
+	}
+}
+
+func TestRestoreHandlerAuth(t *testing.T) {
+	h := restoreHandler{Configuration: &Configuration{}}
+
+	req := httptest.NewRequest("POST", "/db/restore", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without configured token, got %d", rec.Code)
+	}
+
+	h.Configuration.AdminToken = "secret"
+	req = httptest.NewRequest("POST", "/db/restore", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong token, got %d", rec.Code)
+	}
+}
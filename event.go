@@ -5,12 +5,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
+	"github.com/oklog/ulid"
 	"github.com/prometheus/common/log"
 	"hash/adler32"
+	"hash/fnv"
+	"sort"
 	"strings"
 	"time"
 )
@@ -20,9 +25,15 @@ var defaultBucket = []byte("__default__")
 // ErrDecodeError when unmarshaling data
 var ErrDecodeError = errors.New("decode error")
 
+// ErrEventNotFound when there is no event with given id
+var ErrEventNotFound = errors.New("event not found")
+
 // AnyBucket means select all buckets
 const AnyBucket = "_any_"
 
+// eventVersion is current version of serialized events
+const eventVersion = 4
+
 func init() {
 }
 
@@ -40,6 +51,15 @@ func (e *Event) SetTags(t string) {
 	e.Tags = tags
 }
 
+// newEventID generate unique, sortable (by event time) id for event
+func newEventID(ts int64) string {
+	ms := ulid.Timestamp(time.Unix(0, ts))
+	if ts < 0 || ms > ulid.MaxTime() {
+		ms = ulid.Now()
+	}
+	return ulid.MustNew(ms, rand.Reader).String()
+}
+
 // Decode event
 func (e *Event) unmarshal(data []byte) (err error) {
 	defer func() {
@@ -48,7 +68,50 @@ func (e *Event) unmarshal(data []byte) (err error) {
 		}
 	}()
 
-	_, err = e.Unmarshal(data[1:])
+	if len(data) < 2 {
+		return ErrDecodeError
+	}
+
+	switch data[0] {
+	case 1:
+		ev1 := EventV1{}
+		if _, err = ev1.Unmarshal(data[1:]); err == nil {
+			e.ID = ""
+			e.Name = ev1.Name
+			e.Title = ev1.Title
+			e.Time = ev1.Time
+			e.TimeEnd = 0
+			e.Text = ev1.Text
+			e.Tags = ev1.Tags
+		}
+	case 2:
+		ev2 := EventV2{}
+		if _, err = ev2.Unmarshal(data[1:]); err == nil {
+			e.ID = ev2.ID
+			e.Name = ev2.Name
+			e.Title = ev2.Title
+			e.Time = ev2.Time
+			e.TimeEnd = 0
+			e.Text = ev2.Text
+			e.Tags = ev2.Tags
+		}
+	case 3:
+		ev3 := EventV3{}
+		if _, err = ev3.Unmarshal(data[1:]); err == nil {
+			e.ID = ev3.ID
+			e.Name = ev3.Name
+			e.Title = ev3.Title
+			e.Time = ev3.Time
+			e.TimeEnd = ev3.TimeEnd
+			e.Text = ev3.Text
+			e.Tags = ev3.Tags
+		}
+	case eventVersion:
+		_, err = e.Unmarshal(data[1:])
+	default:
+		err = fmt.Errorf("invalid version: %v", data[0])
+	}
+
 	return err
 }
 
@@ -118,24 +181,64 @@ func marshalTSlegacy(ts int64, data []byte) ([]byte, error) {
 	return key.Bytes(), nil
 }
 
+// eventKey return key of event: timestamp followed by hash of event id, so
+// events with the same time get different keys
+func eventKey(e *Event) ([]byte, error) {
+	key, err := marshalTS(e.Time, nil)
+	if err != nil {
+		return nil, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.ID))
+	return h.Sum(key), nil
+}
+
+// nextEventKey change hash part of `key` in place; used to resolve clash
+// with key of other event
+func nextEventKey(key []byte) {
+	for i := len(key) - 1; i >= 8; i-- {
+		if key[i]++; key[i] != 0 {
+			return
+		}
+	}
+}
+
 // encode (marshal) Event
 func (e *Event) marshal() ([]byte, []byte, error) {
-	// KEY: ts(int64)crc(4) (12bytes)
+	// KEY: ts(int64)hash(id)(4) (12bytes)
 	buf, err := e.Marshal(nil)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	key, err := marshalTS(e.Time, buf)
+	key, err := eventKey(e)
 
 	if err == nil {
 		// prefix by version
-		buf = append([]byte{1}, buf...)
+		buf = append([]byte{eventVersion}, buf...)
 	}
 
 	return buf, key, err
 }
 
+// IsRegion return true when event has end time
+func (e *Event) IsRegion() bool {
+	return e.TimeEnd > e.Time
+}
+
+// End return event end time; for point events it is event time
+func (e *Event) End() int64 {
+	if e.TimeEnd > e.Time {
+		return e.TimeEnd
+	}
+	return e.Time
+}
+
+// Overlaps check if event overlap `f`-`t` time range (in nanoseconds)
+func (e *Event) Overlaps(f, t int64) bool {
+	return e.Time <= t && e.End() >= f
+}
+
 // CheckTags check if event has all `tags`
 func (e *Event) CheckTags(tags []string) bool {
 	if tags == nil || len(tags) == 0 {
@@ -162,105 +265,477 @@ func (e *Event) CheckTags(tags []string) bool {
 	return true
 }
 
-// SaveEvent to database
+// SaveEvent to database; concurrent saves are committed in one transaction
 func (db *DB) SaveEvent(e *Event) error {
-	return db.db.Update(func(tx *bolt.Tx) error {
-		name := defaultBucket
-		if e.Name != "" {
-			name = []byte(e.Name)
+	return db.write(func(tx *bolt.Tx) error {
+		return putEvent(tx, e)
+	})
+}
+
+// SaveEvents store all events `events` in one transaction
+func (db *DB) SaveEvents(events []*Event) error {
+	return db.update(func(tx *bolt.Tx) error {
+		for _, e := range events {
+			if err := putEvent(tx, e); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
+
+func eventBucketName(name string) []byte {
+	if name == "" {
+		return defaultBucket
+	}
+	return []byte(name)
+}
+
+// putEvent store event in bucket and update indexes
+func putEvent(tx *bolt.Tx, e *Event) error {
+	name := eventBucketName(e.Name)
+	if !isEventBucket(name) {
+		return fmt.Errorf("invalid event name: %q", e.Name)
+	}
+
+	b, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	if e.ID == "" {
+		e.ID = newEventID(e.Time)
+	}
+
+	b.FillPercent = 0.99
+	data, key, err := e.marshal()
+	if err != nil {
+		return err
+	}
+
+	for b.Get(key) != nil {
+		nextEventKey(key)
+	}
+	if err := b.Put(key, data); err != nil {
+		return err
+	}
+
+	return indexEvent(tx, name, key, e)
+}
+
+// deleteEvent remove event stored under `key` in bucket `b` and its indexes
+func deleteEvent(tx *bolt.Tx, b *bolt.Bucket, bname, key []byte) error {
+	e := &Event{}
+	if err := e.unmarshal(b.Get(key)); err != nil {
+		log.Errorf("ERROR: decode event %v in %s error: %s", key, bname, err)
+	} else if err := unindexEvent(tx, bname, key, e); err != nil {
+		return err
+	}
+
+	return b.Delete(key)
+}
+
+// findEvent by `id`; return event, bucket name and key
+func findEvent(tx *bolt.Tx, id string) (*Event, []byte, []byte, error) {
+	bname, key := lookupEventID(tx, id)
+	if key == nil {
+		return nil, nil, nil, ErrEventNotFound
+	}
+
+	b := tx.Bucket(bname)
+	if b == nil {
+		return nil, nil, nil, ErrEventNotFound
+	}
+
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil, nil, ErrEventNotFound
+	}
+
+	e := &Event{}
+	if err := e.unmarshal(v); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return e, bname, key, nil
+}
+
+// GetEvent find event by `id`
+func (db *DB) GetEvent(id string) (*Event, error) {
+	var event *Event
 
-		b, err := tx.CreateBucketIfNotExists(name)
+	err := db.view(func(tx *bolt.Tx) error {
+		e, _, _, err := findEvent(tx, id)
+		event = e
+		return err
+	})
+
+	return event, err
+}
+
+// UpdateEvent find event by `id` and apply changes by `update` function.
+// Return updated event.
+func (db *DB) UpdateEvent(id string, update func(e *Event) error) (*Event, error) {
+	var event *Event
+
+	err := db.update(func(tx *bolt.Tx) error {
+		e, bname, key, err := findEvent(tx, id)
 		if err != nil {
 			return err
 		}
+		// event after update may be shorter or moved to other bucket
+		longest := isLongestEvent(tx, bname, e)
+
+		if err := update(e); err != nil {
+			return err
+		}
+		// id can't be changed
+		e.ID = id
 
-		b.FillPercent = 0.99
-		data, key, err := e.marshal()
-		if err == nil {
-			return b.Put(key, data)
+		if err := deleteEvent(tx, tx.Bucket(bname), bname, key); err != nil {
+			return err
 		}
 
-		return err
+		event = e
+		if err := putEvent(tx, e); err != nil {
+			return err
+		}
+		if longest {
+			return updateBucketSpan(tx, bname, tx.Bucket(bname))
+		}
+		return nil
 	})
+
+	return event, err
 }
 
-func getEventsFromBucket(f, t int64, b *bolt.Bucket, bname []byte) []*Event {
-	fkey, err := marshalTS(f, nil)
-	if err != nil {
-		log.Errorf("ERROR: marshalTS for %v error: %s", t, err)
-		fkey = []byte{0}
-	}
+// UpsertEvent save event `e` or replace event previously saved with the same
+// external reference `ref`. Return true when new event was created.
+// Concurrent upserts are committed in one transaction.
+func (db *DB) UpsertEvent(ref []byte, e *Event) (bool, error) {
+	created := false
+
+	err := db.write(func(tx *bolt.Tx) error {
+		created = false
+		refs := indexSubBucket(tx, refIndexBucket)
+		if refs == nil {
+			return fmt.Errorf("missing ref index")
+		}
 
-	c := b.Cursor()
-	var events []*Event
+		if id := refs.Get(ref); id != nil {
+			prev, bname, key, err := findEvent(tx, string(id))
+			switch err {
+			case nil:
+				// new event may be shorter or placed in other bucket
+				longest := isLongestEvent(tx, bname, prev)
+				if err := deleteEvent(tx, tx.Bucket(bname), bname, key); err != nil {
+					return err
+				}
+				e.ID = prev.ID
+				if err := putEvent(tx, e); err != nil {
+					return err
+				}
+				if longest {
+					return updateBucketSpan(tx, bname, tx.Bucket(bname))
+				}
+				return nil
+			case ErrEventNotFound:
+				// event was deleted; create new one
+			default:
+				return err
+			}
+		}
 
-	for k, v := c.Seek(fkey); k != nil; k, v = c.Next() {
-		if ts, err := unmarshalTS(k); err != nil {
-			log.Errorf("ERROR: decode event ts error: %s", err.Error())
-		} else if ts >= f && ts <= t {
-			var err error
-			e := &Event{}
+		created = true
+		e.ID = ""
+		if err := putEvent(tx, e); err != nil {
+			return err
+		}
+		return refs.Put(ref, []byte(e.ID))
+	})
 
-			if v == nil || len(v) < 2 {
-				err = fmt.Errorf("invalid data")
-			} else {
-				switch v[0] {
-				case 1:
-					err = e.unmarshal(v)
-				default:
-					err = fmt.Errorf("invalid version: %v", v[0])
-				}
+	return created, err
+}
+
+// DeleteEvent find and delete event by `id`
+func (db *DB) DeleteEvent(id string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		e, bname, key, err := findEvent(tx, id)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(bname)
+		longest := isLongestEvent(tx, bname, e)
+		if err := deleteEvent(tx, b, bname, key); err != nil {
+			return err
+		}
+		if longest {
+			return updateBucketSpan(tx, bname, b)
+		}
+		return nil
+	})
+}
+
+// upgradeEvents rewrite events stored in legacy format to current version.
+// Legacy events get new id.
+func upgradeEvents(tx *bolt.Tx) (int, error) {
+	upgraded := 0
+	err := forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) > 0 && v[0] != eventVersion {
+				keys = append(keys, append([]byte(nil), k...))
 			}
+		}
 
-			if err == nil && e != nil {
-				events = append(events, e)
-			} else {
-				log.Errorf("ERROR: decode event ts: %v/%v error: %s", k, ts, err)
+		for _, k := range keys {
+			e := &Event{}
+			if err := e.unmarshal(b.Get(k)); err != nil {
+				log.Errorf("ERROR: upgrade event %v in %s error: %s", k, name, err)
+				continue
+			}
+			if e.ID == "" {
+				e.ID = newEventID(e.Time)
+			}
+			data, _, err := e.marshal()
+			if err != nil {
+				return err
 			}
+			if err := b.Put(k, data); err != nil {
+				return err
+			}
+			upgraded++
 		}
+		return nil
+	})
+	return upgraded, err
+}
+
+// Query define criteria for selecting events
+type Query struct {
+	From time.Time
+	To   time.Time
+	// Name of bucket; AnyBucket for all buckets
+	Name string
+	// Tags expression; nil for any tags
+	Tags TagExpr
+	// Text is full text query on Title and Text
+	Text string
+	// DashboardUID of events; empty for any
+	DashboardUID string
+	// PanelID of events; 0 for any
+	PanelID int64
+	// Limit number of returned events; 0 - no limit
+	Limit int
+	// Order of events by time: OrderAsc (default) or OrderDesc
+	Order string
+	// Cursor returned by previous query
+	Cursor string
+}
+
+// queryFilter check events against query criteria
+type queryFilter struct {
+	f, t      int64
+	tags      TagExpr
+	text      textQuery
+	dashboard string
+	panel     int64
+}
+
+func newQueryFilter(q *Query) *queryFilter {
+	return &queryFilter{
+		f:         q.From.UnixNano(),
+		t:         q.To.UnixNano(),
+		tags:      q.Tags,
+		text:      parseTextQuery(q.Text),
+		dashboard: q.DashboardUID,
+		panel:     q.PanelID,
 	}
+}
 
-	return events
+func (qf *queryFilter) match(e *Event) bool {
+	return e.Overlaps(qf.f, qf.t) &&
+		(qf.tags == nil || qf.tags.Match(e.Tags)) &&
+		(qf.dashboard == "" || qf.dashboard == e.DashboardUID) &&
+		(qf.panel == 0 || qf.panel == e.PanelID) &&
+		(len(qf.text) == 0 || qf.text.Match(e))
 }
 
-// GetEvents from database according to `from`-`to` time range and bucket `name`
-func (db *DB) GetEvents(from, to time.Time, name string) ([]*Event, error) {
-	log.Debugf("GetEvents %s - %s [%s]", from, to, name)
+// ErrStopIteration may be returned by IterEvents callback to stop iteration
+// without error
+var ErrStopIteration = errors.New("stop iteration")
 
-	f := from.UnixNano()
-	t := to.UnixNano()
-	if t < f {
-		return nil, fmt.Errorf("wrong time range (from > to)")
+// Validate query parameters
+func (q *Query) Validate() error {
+	if q.To.Before(q.From) {
+		return fmt.Errorf("wrong time range (from > to)")
+	}
+	switch q.Order {
+	case "", OrderAsc, OrderDesc:
+	default:
+		return ErrInvalidOrder
 	}
+	_, err := decodeCursor(q.Cursor)
+	return err
+}
 
-	var events []*Event
+// IterEvents call `fn` for each event matching query `q` (see GetEvents).
+// Events are decoded lazily; iteration stop when `fn` return error,
+// context is done or database file is replaced (ErrDBReplaced). When number
+// of events is limited by q.Limit and there are more events, return cursor
+// for next page.
+func (db *DB) IterEvents(ctx context.Context, q Query, fn func(*Event) error) (string, error) {
+	log.Debugf("IterEvents %+v", q)
 
-	err := db.db.View(func(tx *bolt.Tx) error {
-		if name == AnyBucket {
-			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-				es := getEventsFromBucket(f, t, b, name)
-				events = append(events, es...)
-				return nil
-			})
-		}
+	if err := q.Validate(); err != nil {
+		return "", err
+	}
+
+	after, _ := decodeCursor(q.Cursor)
+	desc := q.Order == OrderDesc
+	qf := newQueryFilter(&q)
+	var next string
 
-		bname := defaultBucket
-		if name != "" {
-			bname = []byte(name)
+	err := db.view(func(tx *bolt.Tx) error {
+		ictx, done := db.startIteration(ctx)
+		defer done()
+
+		it := newQueryIterator(tx, &q, qf, desc, after)
+		var err error
+		next, err = iterQuery(ictx, it, &q, qf, fn)
+		if err != nil && ictx.Err() != nil && ctx.Err() == nil {
+			err = ErrDBReplaced
 		}
+		return err
+	})
 
-		b := tx.Bucket(bname)
-		if b == nil {
-			log.Infof("unknown bucket name: %v", name)
+	return next, err
+}
+
+// GetEvents from database according to query `q`. Return all events that
+// overlap given time range and match tags expression and text query.
+// Events are ordered by time. When number of events is limited by q.Limit and
+// there are more events, return also cursor for next page.
+func (db *DB) GetEvents(q Query) ([]*Event, string, error) {
+	var events []*Event
+	next, err := db.IterEvents(context.Background(), q, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, next, err
+}
+
+// newQueryIterator create iterator over events that may match query
+func newQueryIterator(tx *bolt.Tx, q *Query, qf *queryFilter, desc bool,
+	after *eventLocation) locationIterator {
+
+	if locs, ok := findEventsInIndex(tx, q, qf); ok {
+		return newSliceIterator(tx, locs, desc, after)
+	}
+
+	if q.Name == AnyBucket {
+		mi := &mergeIterator{desc: desc}
+		forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+			// region events started before `f` may overlap range
+			f := spanStart(qf.f, bucketMaxSpan(tx, name))
+			mi.iters = append(mi.iters, newBucketIterator(b, name, f, qf.t, desc, after))
 			return nil
+		})
+		return mi
+	}
+
+	bname := eventBucketName(q.Name)
+	b := tx.Bucket(bname)
+	if b == nil {
+		log.Infof("unknown bucket name: %v", q.Name)
+		return &sliceIterator{}
+	}
+
+	f := spanStart(qf.f, bucketMaxSpan(tx, bname))
+	return newBucketIterator(b, bname, f, qf.t, desc, after)
+}
+
+type eventLocations map[string]eventLocation
+
+func (el eventLocations) add(key, bname []byte) error {
+	el[string(key)+string(bname)] = eventLocation{key, bname}
+	return nil
+}
+
+// intersect return locations existing in both `el` and `other`
+func (el eventLocations) intersect(other eventLocations) eventLocations {
+	if el == nil {
+		return other
+	}
+	res := make(eventLocations)
+	for k, v := range el {
+		if _, ok := other[k]; ok {
+			res[k] = v
 		}
+	}
+	return res
+}
 
-		events = getEventsFromBucket(f, t, b, bname)
-		return nil
+// sorted return locations sorted by key (time) and bucket name
+func (el eventLocations) sorted() []eventLocation {
+	locs := make([]eventLocation, 0, len(el))
+	for _, loc := range el {
+		locs = append(locs, loc)
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		return locs[i].compare(&locs[j]) < 0
 	})
+	return locs
+}
+
+// findEventsInIndex find location of events that may match query using tags
+// and text indexes. Return false when query can't be resolved by indexes.
+func findEventsInIndex(tx *bolt.Tx, q *Query, qf *queryFilter) ([]eventLocation, bool) {
+	var tags []string
+	if q.Tags != nil {
+		tags = indexTags(q.Tags)
+	}
+	if len(tags) == 0 && len(qf.text) == 0 {
+		return nil, false
+	}
+
+	var bname []byte
+	span := int64(0)
+	if q.Name == AnyBucket {
+		span = maxSpan(tx)
+	} else {
+		bname = eventBucketName(q.Name)
+		span = bucketMaxSpan(tx, bname)
+	}
+	f := spanStart(qf.f, span)
 
-	return events, err
+	var res eventLocations
+
+	if len(tags) > 0 {
+		locs := make(eventLocations)
+		for _, tag := range tags {
+			if err := scanTagIndex(tx, tag, f, qf.t, bname, locs.add); err != nil {
+				log.Errorf("ERROR: scan tag index error: %s", err)
+			}
+		}
+		res = locs
+	}
+
+	for _, term := range qf.text {
+		if res != nil && len(res) == 0 {
+			break
+		}
+		token, prefix := term.lookupToken()
+		locs := make(eventLocations)
+		if err := scanTextIndex(tx, token, prefix, f, qf.t, bname, locs.add); err != nil {
+			log.Errorf("ERROR: scan text index error: %s", err)
+		}
+		res = res.intersect(locs)
+	}
+
+	return res.sorted(), true
 }
 
 func getEventsKeyFromBucket(f, t int64, b *bolt.Bucket) [][]byte {
@@ -291,44 +766,74 @@ func (db *DB) DeleteEvents(from, to time.Time, name string) (int, error) {
 
 	deleted := 0
 
-	err := db.db.Update(func(tx *bolt.Tx) error {
-		if name == AnyBucket {
-			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
-				keys := getEventsKeyFromBucket(f, t, b)
-
-				for _, k := range keys {
-					if err := b.Delete(k); err != nil {
-						return err
-					}
-				}
-
-				deleted += len(keys)
-				return nil
-			})
+	deleteFromBucket := func(tx *bolt.Tx, name []byte, b *bolt.Bucket) error {
+		keys := getEventsKeyFromBucket(f, t, b)
+		for _, k := range keys {
+			if err := deleteEvent(tx, b, name, k); err != nil {
+				return err
+			}
 		}
 
-		bname := defaultBucket
-		if name != "" {
-			bname = []byte(name)
+		deleted += len(keys)
+		if len(keys) > 0 {
+			return updateBucketSpan(tx, name, b)
 		}
+		return nil
+	}
 
-		b := tx.Bucket(bname)
-		if b == nil {
-			log.Infof("unknown bucket name: %v", name)
-			return nil
-		}
-		{
-			keys := getEventsKeyFromBucket(f, t, b)
-			for _, k := range keys {
-				if err := b.Delete(k); err != nil {
-					return err
-				}
+	err := db.update(func(tx *bolt.Tx) error {
+		if name == AnyBucket {
+			if err := forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+				return deleteFromBucket(tx, name, b)
+			}); err != nil {
+				return err
+			}
+		} else {
+			bname := eventBucketName(name)
+			b := tx.Bucket(bname)
+			if b == nil {
+				log.Infof("unknown bucket name: %v", name)
+				return nil
+			}
+			if err := deleteFromBucket(tx, bname, b); err != nil {
+				return err
 			}
-			deleted += len(keys)
 		}
 
-		return nil
+		if deleted == 0 {
+			return nil
+		}
+		_, err := pruneRefs(tx)
+		return err
 	})
 
 	return deleted, err
 }
+
+// GetNames return names of all buckets with events
+func (db *DB) GetNames() ([]string, error) {
+	var names []string
+	err := db.view(func(tx *bolt.Tx) error {
+		return forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// GetTags return all tags used by events
+func (db *DB) GetTags() ([]string, error) {
+	var tags []string
+	err := db.view(func(tx *bolt.Tx) error {
+		idx := indexSubBucket(tx, tagIndexBucket)
+		if idx == nil {
+			return errMissingIndex("tag")
+		}
+		return forEachTerm(idx, nil, func(term []byte) error {
+			tags = append(tags, string(term))
+			return nil
+		})
+	})
+	return tags, err
+}
@@ -13,6 +13,1324 @@ var (
 )
 
 type Event struct {
+	ID           string
+	Name         string
+	Title        string
+	Time         int64
+	TimeEnd      int64
+	Text         string
+	Tags         []string
+	DashboardUID string
+	PanelID      int64
+}
+
+func (d *Event) Size() (s uint64) {
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := l
+					for t >= 0x80 {
+						t >>= 7
+						s++
+					}
+					s++
+
+				}
+				s += l
+			}
+
+		}
+
+	}
+	{
+		l := uint64(len(d.DashboardUID))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	s += 24
+	return
+}
+func (d *Event) Marshal(buf []byte) ([]byte, error) {
+	size := d.Size()
+	{
+		if uint64(cap(buf)) >= size {
+			buf = buf[:size]
+		} else {
+			buf = make([]byte, size)
+		}
+	}
+	i := uint64(0)
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.ID)
+		i += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Name)
+		i += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Title)
+		i += l
+	}
+	{
+
+		buf[i+0+0] = byte(d.Time >> 0)
+
+		buf[i+1+0] = byte(d.Time >> 8)
+
+		buf[i+2+0] = byte(d.Time >> 16)
+
+		buf[i+3+0] = byte(d.Time >> 24)
+
+		buf[i+4+0] = byte(d.Time >> 32)
+
+		buf[i+5+0] = byte(d.Time >> 40)
+
+		buf[i+6+0] = byte(d.Time >> 48)
+
+		buf[i+7+0] = byte(d.Time >> 56)
+
+	}
+	{
+
+		buf[i+0+8] = byte(d.TimeEnd >> 0)
+
+		buf[i+1+8] = byte(d.TimeEnd >> 8)
+
+		buf[i+2+8] = byte(d.TimeEnd >> 16)
+
+		buf[i+3+8] = byte(d.TimeEnd >> 24)
+
+		buf[i+4+8] = byte(d.TimeEnd >> 32)
+
+		buf[i+5+8] = byte(d.TimeEnd >> 40)
+
+		buf[i+6+8] = byte(d.TimeEnd >> 48)
+
+		buf[i+7+8] = byte(d.TimeEnd >> 56)
+
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+16] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+16] = byte(t)
+			i++
+
+		}
+		copy(buf[i+16:], d.Text)
+		i += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+16] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+16] = byte(t)
+			i++
+
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := uint64(l)
+
+					for t >= 0x80 {
+						buf[i+16] = byte(t) | 0x80
+						t >>= 7
+						i++
+					}
+					buf[i+16] = byte(t)
+					i++
+
+				}
+				copy(buf[i+16:], d.Tags[k0])
+				i += l
+			}
+
+		}
+	}
+	{
+		l := uint64(len(d.DashboardUID))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+16] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+16] = byte(t)
+			i++
+
+		}
+		copy(buf[i+16:], d.DashboardUID)
+		i += l
+	}
+	{
+
+		buf[i+0+16] = byte(d.PanelID >> 0)
+
+		buf[i+1+16] = byte(d.PanelID >> 8)
+
+		buf[i+2+16] = byte(d.PanelID >> 16)
+
+		buf[i+3+16] = byte(d.PanelID >> 24)
+
+		buf[i+4+16] = byte(d.PanelID >> 32)
+
+		buf[i+5+16] = byte(d.PanelID >> 40)
+
+		buf[i+6+16] = byte(d.PanelID >> 48)
+
+		buf[i+7+16] = byte(d.PanelID >> 56)
+
+	}
+	return buf[:i+24], nil
+}
+
+func (d *Event) Unmarshal(buf []byte) (uint64, error) {
+	i := uint64(0)
+
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.ID = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Name = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Title = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+
+		d.Time = 0 | (int64(buf[i+0+0]) << 0) | (int64(buf[i+1+0]) << 8) | (int64(buf[i+2+0]) << 16) | (int64(buf[i+3+0]) << 24) | (int64(buf[i+4+0]) << 32) | (int64(buf[i+5+0]) << 40) | (int64(buf[i+6+0]) << 48) | (int64(buf[i+7+0]) << 56)
+
+	}
+	{
+
+		d.TimeEnd = 0 | (int64(buf[i+0+8]) << 0) | (int64(buf[i+1+8]) << 8) | (int64(buf[i+2+8]) << 16) | (int64(buf[i+3+8]) << 24) | (int64(buf[i+4+8]) << 32) | (int64(buf[i+5+8]) << 40) | (int64(buf[i+6+8]) << 48) | (int64(buf[i+7+8]) << 56)
+
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+16] & 0x7F)
+			for buf[i+16]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+16]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Text = string(buf[i+16 : i+16+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+16] & 0x7F)
+			for buf[i+16]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+16]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		if uint64(cap(d.Tags)) >= l {
+			d.Tags = d.Tags[:l]
+		} else {
+			d.Tags = make([]string, l)
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(0)
+
+				{
+
+					bs := uint8(7)
+					t := uint64(buf[i+16] & 0x7F)
+					for buf[i+16]&0x80 == 0x80 {
+						i++
+						t |= uint64(buf[i+16]&0x7F) << bs
+						bs += 7
+					}
+					i++
+
+					l = t
+
+				}
+				d.Tags[k0] = string(buf[i+16 : i+16+l])
+				i += l
+			}
+
+		}
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+16] & 0x7F)
+			for buf[i+16]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+16]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.DashboardUID = string(buf[i+16 : i+16+l])
+		i += l
+	}
+	{
+
+		d.PanelID = 0 | (int64(buf[i+0+16]) << 0) | (int64(buf[i+1+16]) << 8) | (int64(buf[i+2+16]) << 16) | (int64(buf[i+3+16]) << 24) | (int64(buf[i+4+16]) << 32) | (int64(buf[i+5+16]) << 40) | (int64(buf[i+6+16]) << 48) | (int64(buf[i+7+16]) << 56)
+
+	}
+	return i + 24, nil
+}
+
+type EventV3 struct {
+	ID      string
+	Name    string
+	Title   string
+	Time    int64
+	TimeEnd int64
+	Text    string
+	Tags    []string
+}
+
+func (d *EventV3) Size() (s uint64) {
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := l
+					for t >= 0x80 {
+						t >>= 7
+						s++
+					}
+					s++
+
+				}
+				s += l
+			}
+
+		}
+
+	}
+	s += 16
+	return
+}
+func (d *EventV3) Marshal(buf []byte) ([]byte, error) {
+	size := d.Size()
+	{
+		if uint64(cap(buf)) >= size {
+			buf = buf[:size]
+		} else {
+			buf = make([]byte, size)
+		}
+	}
+	i := uint64(0)
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.ID)
+		i += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Name)
+		i += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Title)
+		i += l
+	}
+	{
+
+		buf[i+0+0] = byte(d.Time >> 0)
+
+		buf[i+1+0] = byte(d.Time >> 8)
+
+		buf[i+2+0] = byte(d.Time >> 16)
+
+		buf[i+3+0] = byte(d.Time >> 24)
+
+		buf[i+4+0] = byte(d.Time >> 32)
+
+		buf[i+5+0] = byte(d.Time >> 40)
+
+		buf[i+6+0] = byte(d.Time >> 48)
+
+		buf[i+7+0] = byte(d.Time >> 56)
+
+	}
+	{
+
+		buf[i+0+8] = byte(d.TimeEnd >> 0)
+
+		buf[i+1+8] = byte(d.TimeEnd >> 8)
+
+		buf[i+2+8] = byte(d.TimeEnd >> 16)
+
+		buf[i+3+8] = byte(d.TimeEnd >> 24)
+
+		buf[i+4+8] = byte(d.TimeEnd >> 32)
+
+		buf[i+5+8] = byte(d.TimeEnd >> 40)
+
+		buf[i+6+8] = byte(d.TimeEnd >> 48)
+
+		buf[i+7+8] = byte(d.TimeEnd >> 56)
+
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+16] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+16] = byte(t)
+			i++
+
+		}
+		copy(buf[i+16:], d.Text)
+		i += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+16] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+16] = byte(t)
+			i++
+
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := uint64(l)
+
+					for t >= 0x80 {
+						buf[i+16] = byte(t) | 0x80
+						t >>= 7
+						i++
+					}
+					buf[i+16] = byte(t)
+					i++
+
+				}
+				copy(buf[i+16:], d.Tags[k0])
+				i += l
+			}
+
+		}
+	}
+	return buf[:i+16], nil
+}
+
+func (d *EventV3) Unmarshal(buf []byte) (uint64, error) {
+	i := uint64(0)
+
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.ID = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Name = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Title = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+
+		d.Time = 0 | (int64(buf[i+0+0]) << 0) | (int64(buf[i+1+0]) << 8) | (int64(buf[i+2+0]) << 16) | (int64(buf[i+3+0]) << 24) | (int64(buf[i+4+0]) << 32) | (int64(buf[i+5+0]) << 40) | (int64(buf[i+6+0]) << 48) | (int64(buf[i+7+0]) << 56)
+
+	}
+	{
+
+		d.TimeEnd = 0 | (int64(buf[i+0+8]) << 0) | (int64(buf[i+1+8]) << 8) | (int64(buf[i+2+8]) << 16) | (int64(buf[i+3+8]) << 24) | (int64(buf[i+4+8]) << 32) | (int64(buf[i+5+8]) << 40) | (int64(buf[i+6+8]) << 48) | (int64(buf[i+7+8]) << 56)
+
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+16] & 0x7F)
+			for buf[i+16]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+16]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Text = string(buf[i+16 : i+16+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+16] & 0x7F)
+			for buf[i+16]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+16]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		if uint64(cap(d.Tags)) >= l {
+			d.Tags = d.Tags[:l]
+		} else {
+			d.Tags = make([]string, l)
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(0)
+
+				{
+
+					bs := uint8(7)
+					t := uint64(buf[i+16] & 0x7F)
+					for buf[i+16]&0x80 == 0x80 {
+						i++
+						t |= uint64(buf[i+16]&0x7F) << bs
+						bs += 7
+					}
+					i++
+
+					l = t
+
+				}
+				d.Tags[k0] = string(buf[i+16 : i+16+l])
+				i += l
+			}
+
+		}
+	}
+	return i + 16, nil
+}
+
+type EventV2 struct {
+	ID    string
+	Name  string
+	Title string
+	Time  int64
+	Text  string
+	Tags  []string
+}
+
+func (d *EventV2) Size() (s uint64) {
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := l
+					for t >= 0x80 {
+						t >>= 7
+						s++
+					}
+					s++
+
+				}
+				s += l
+			}
+
+		}
+
+	}
+	s += 8
+	return
+}
+func (d *EventV2) Marshal(buf []byte) ([]byte, error) {
+	size := d.Size()
+	{
+		if uint64(cap(buf)) >= size {
+			buf = buf[:size]
+		} else {
+			buf = make([]byte, size)
+		}
+	}
+	i := uint64(0)
+
+	{
+		l := uint64(len(d.ID))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.ID)
+		i += l
+	}
+	{
+		l := uint64(len(d.Name))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Name)
+		i += l
+	}
+	{
+		l := uint64(len(d.Title))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Title)
+		i += l
+	}
+	{
+
+		buf[i+0+0] = byte(d.Time >> 0)
+
+		buf[i+1+0] = byte(d.Time >> 8)
+
+		buf[i+2+0] = byte(d.Time >> 16)
+
+		buf[i+3+0] = byte(d.Time >> 24)
+
+		buf[i+4+0] = byte(d.Time >> 32)
+
+		buf[i+5+0] = byte(d.Time >> 40)
+
+		buf[i+6+0] = byte(d.Time >> 48)
+
+		buf[i+7+0] = byte(d.Time >> 56)
+
+	}
+	{
+		l := uint64(len(d.Text))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+8] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+8] = byte(t)
+			i++
+
+		}
+		copy(buf[i+8:], d.Text)
+		i += l
+	}
+	{
+		l := uint64(len(d.Tags))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+8] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+8] = byte(t)
+			i++
+
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(len(d.Tags[k0]))
+
+				{
+
+					t := uint64(l)
+
+					for t >= 0x80 {
+						buf[i+8] = byte(t) | 0x80
+						t >>= 7
+						i++
+					}
+					buf[i+8] = byte(t)
+					i++
+
+				}
+				copy(buf[i+8:], d.Tags[k0])
+				i += l
+			}
+
+		}
+	}
+	return buf[:i+8], nil
+}
+
+func (d *EventV2) Unmarshal(buf []byte) (uint64, error) {
+	i := uint64(0)
+
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.ID = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Name = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Title = string(buf[i+0 : i+0+l])
+		i += l
+	}
+	{
+
+		d.Time = 0 | (int64(buf[i+0+0]) << 0) | (int64(buf[i+1+0]) << 8) | (int64(buf[i+2+0]) << 16) | (int64(buf[i+3+0]) << 24) | (int64(buf[i+4+0]) << 32) | (int64(buf[i+5+0]) << 40) | (int64(buf[i+6+0]) << 48) | (int64(buf[i+7+0]) << 56)
+
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+8] & 0x7F)
+			for buf[i+8]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+8]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Text = string(buf[i+8 : i+8+l])
+		i += l
+	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+8] & 0x7F)
+			for buf[i+8]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+8]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		if uint64(cap(d.Tags)) >= l {
+			d.Tags = d.Tags[:l]
+		} else {
+			d.Tags = make([]string, l)
+		}
+		for k0 := range d.Tags {
+
+			{
+				l := uint64(0)
+
+				{
+
+					bs := uint8(7)
+					t := uint64(buf[i+8] & 0x7F)
+					for buf[i+8]&0x80 == 0x80 {
+						i++
+						t |= uint64(buf[i+8]&0x7F) << bs
+						bs += 7
+					}
+					i++
+
+					l = t
+
+				}
+				d.Tags[k0] = string(buf[i+8 : i+8+l])
+				i += l
+			}
+
+		}
+	}
+	return i + 8, nil
+}
+
+type EventV1 struct {
 	Name  string
 	Title string
 	Time  int64
@@ -20,7 +1338,7 @@ type Event struct {
 	Tags  []string
 }
 
-func (d *Event) Size() (s uint64) {
+func (d *EventV1) Size() (s uint64) {
 
 	{
 		l := uint64(len(d.Name))
@@ -105,7 +1423,7 @@ func (d *Event) Size() (s uint64) {
 	s += 8
 	return
 }
-func (d *Event) Marshal(buf []byte) ([]byte, error) {
+func (d *EventV1) Marshal(buf []byte) ([]byte, error) {
 	size := d.Size()
 	{
 		if uint64(cap(buf)) >= size {
@@ -235,7 +1553,7 @@ func (d *Event) Marshal(buf []byte) ([]byte, error) {
 	return buf[:i+8], nil
 }
 
-func (d *Event) Unmarshal(buf []byte) (uint64, error) {
+func (d *EventV1) Unmarshal(buf []byte) (uint64, error) {
 	i := uint64(0)
 
 	{
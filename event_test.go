@@ -129,6 +129,9 @@ func BenchmarkUnmarshalTSlegacy(b *testing.B) {
 }
 
 func eventsCompare(e, e2 *Event, t *testing.T) {
+	if e.ID != e2.ID {
+		t.Fatalf("id not match: %+v vs %+v", e, e2)
+	}
 	if e.Name != e2.Name {
 		t.Fatalf("name not match: %+v vs %+v", e, e2)
 	}
@@ -138,9 +141,15 @@ func eventsCompare(e, e2 *Event, t *testing.T) {
 	if e.Time != e2.Time {
 		t.Fatalf("time not match: %+v vs %+v", e, e2)
 	}
+	if e.TimeEnd != e2.TimeEnd {
+		t.Fatalf("time end not match: %+v vs %+v", e, e2)
+	}
 	if e.Text != e2.Text {
 		t.Fatalf("text not match: %+v vs %+v", e, e2)
 	}
+	if e.DashboardUID != e2.DashboardUID || e.PanelID != e2.PanelID {
+		t.Fatalf("dashboard not match: %+v vs %+v", e, e2)
+	}
 	for i, tag := range e.Tags {
 		if tag != e2.Tags[i] {
 			t.Fatalf("tags not match: %+v vs %+v", e, e2)
@@ -151,10 +160,14 @@ func eventsCompare(e, e2 *Event, t *testing.T) {
 func TestMarshal(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		e := &Event{
+			ID:    newEventID(int64(i)),
 			Name:  randomStr(0),
 			Title: randomStr(0),
 			Time:  int64(i),
 			Text:  randomStr(0),
+
+			DashboardUID: randomStr(10),
+			PanelID:      int64(i % 10),
 		}
 		e.SetTags(randomStr(50))
 
@@ -172,6 +185,82 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshalV1(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ev1 := &EventV1{
+			Name:  randomStr(0),
+			Title: randomStr(0),
+			Time:  int64(i),
+			Text:  randomStr(0),
+			Tags:  []string{randomStr(10), randomStr(10)},
+		}
+		data, err := ev1.Marshal(nil)
+		if err != nil {
+			t.Fatalf("marshal error: %s (%+v)", err, ev1)
+		}
+
+		e := &Event{}
+		if err := e.unmarshal(append([]byte{1}, data...)); err != nil {
+			t.Fatalf("decode error: %s (%+v)", err, ev1)
+		}
+		eventsCompare(&Event{
+			Name:  ev1.Name,
+			Title: ev1.Title,
+			Time:  ev1.Time,
+			Text:  ev1.Text,
+			Tags:  ev1.Tags,
+		}, e, t)
+	}
+}
+
+func TestUnmarshalV3(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ev3 := &EventV3{
+			ID:      newEventID(int64(i)),
+			Name:    randomStr(0),
+			Title:   randomStr(0),
+			Time:    int64(i),
+			TimeEnd: int64(i + 10),
+			Text:    randomStr(0),
+			Tags:    []string{randomStr(10), randomStr(10)},
+		}
+		data, err := ev3.Marshal(nil)
+		if err != nil {
+			t.Fatalf("marshal error: %s (%+v)", err, ev3)
+		}
+
+		e := &Event{}
+		if err := e.unmarshal(append([]byte{3}, data...)); err != nil {
+			t.Fatalf("decode error: %s (%+v)", err, ev3)
+		}
+		eventsCompare(&Event{
+			ID:      ev3.ID,
+			Name:    ev3.Name,
+			Title:   ev3.Title,
+			Time:    ev3.Time,
+			TimeEnd: ev3.TimeEnd,
+			Text:    ev3.Text,
+			Tags:    ev3.Tags,
+		}, e, t)
+	}
+}
+
+func TestNewEventID(t *testing.T) {
+	ids := make(map[string]bool)
+	prev := ""
+	for i := int64(1); i < 1000; i++ {
+		id := newEventID(i * int64(time.Millisecond))
+		if ids[id] {
+			t.Fatalf("duplicated id: %s", id)
+		}
+		if id <= prev {
+			t.Fatalf("ids not sorted: %s <= %s", id, prev)
+		}
+		ids[id] = true
+		prev = id
+	}
+}
+
 func TestSetTags(t *testing.T) {
 	e := &Event{}
 	e.SetTags("tag1")
@@ -0,0 +1,166 @@
+//
+// export.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// exportQuery create query for export/import. By default query select all
+// events from all buckets.
+func exportQuery(from, to, name, tags string) (Query, error) {
+	q := Query{
+		From: time.Unix(0, 0),
+		To:   time.Unix(0, math.MaxInt64),
+		Name: AnyBucket,
+	}
+
+	now := time.Now().UTC()
+	var err error
+	if from != "" {
+		if q.From, err = parseTimeIn(from, now); err != nil {
+			return q, fmt.Errorf("wrong from date: %s", err)
+		}
+	}
+	if to != "" {
+		if q.To, err = parseTimeIn(to, now); err != nil {
+			return q, fmt.Errorf("wrong to date: %s", err)
+		}
+	}
+
+	var tagQuery string
+	if name != "" {
+		q.Name, tagQuery = parseName(name)
+	}
+	if q.Tags, err = parseTagQuery(tagQuery, tags); err != nil {
+		return q, fmt.Errorf("wrong tags query: %s", err)
+	}
+
+	return q, q.Validate()
+}
+
+// ExportEvents write events matching query `q` into `w` as JSON Lines; return
+// number of exported events
+func (db *DB) ExportEvents(ctx context.Context, w io.Writer, q Query) (int, error) {
+	return exportEvents(ctx, db, w, q)
+}
+
+// exportEvents write events from store `s` matching query `q` into `w`
+func exportEvents(ctx context.Context, s EventStore, w io.Writer, q Query) (int, error) {
+	enc := json.NewEncoder(w)
+	exported := 0
+	_, err := s.IterEvents(ctx, q, func(e *Event) error {
+		exported++
+		return enc.Encode(e)
+	})
+	return exported, err
+}
+
+// ImportEvents read events in JSON Lines format (as written by ExportEvents)
+// from `r` and save events matching query `q` (time range, name, tags).
+// Events with id of existing event replace it. Return number of imported and
+// skipped events.
+func (db *DB) ImportEvents(r io.Reader, q Query) (imported, skipped int, err error) {
+	return importEvents(r, q, func(batch []*Event) error {
+		return db.update(func(tx *bolt.Tx) error {
+			for _, e := range batch {
+				if err := importEvent(tx, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// importEvents read events from `r` and pass events matching query `q` in
+// batches to `save`
+func importEvents(r io.Reader, q Query, save func(batch []*Event) error) (imported, skipped int, err error) {
+	qf := newQueryFilter(&q)
+	var bname []byte
+	if q.Name != AnyBucket {
+		bname = eventBucketName(q.Name)
+	}
+
+	var batch []*Event
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := save(batch)
+		if err == nil {
+			imported += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), bulkMaxLineSize)
+	line := 0
+	for s.Scan() {
+		line++
+		data := bytes.TrimSpace(s.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		e := &Event{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return imported, skipped, fmt.Errorf("line %d: %s", line, err)
+		}
+		if e.Time == 0 || (e.TimeEnd != 0 && e.TimeEnd < e.Time) {
+			return imported, skipped, fmt.Errorf("line %d: wrong time", line)
+		}
+		if !isEventBucket(eventBucketName(e.Name)) {
+			return imported, skipped, fmt.Errorf("line %d: wrong name", line)
+		}
+
+		if (bname != nil && !bytes.Equal(bname, eventBucketName(e.Name))) || !qf.match(e) {
+			skipped++
+			continue
+		}
+
+		batch = append(batch, e)
+		if len(batch) >= bulkBatchSize {
+			if err := flush(); err != nil {
+				return imported, skipped, err
+			}
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return imported, skipped, fmt.Errorf("line %d: %s", line+1, err)
+	}
+
+	err = flush()
+	return imported, skipped, err
+}
+
+// importEvent save event `e`; event with the same id is replaced
+func importEvent(tx *bolt.Tx, e *Event) error {
+	if e.ID != "" {
+		if bname, key := lookupEventID(tx, e.ID); key != nil {
+			if b := tx.Bucket(bname); b != nil {
+				if err := deleteEvent(tx, b, bname, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return putEvent(tx, e)
+}
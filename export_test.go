@@ -0,0 +1,87 @@
+//
+// export_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testExportImport(t *testing.T, db EventStore) {
+	base := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		e := &Event{
+			Name:    []string{"", "b1", "b2"}[i%3],
+			Title:   "e" + strconv.Itoa(i),
+			Time:    base.Add(time.Duration(i) * time.Hour).UnixNano(),
+			Text:    "text\nline 2",
+			PanelID: int64(i),
+		}
+		if i%2 == 0 {
+			e.TimeEnd = e.Time + int64(time.Minute)
+			e.SetTags("even")
+		}
+		if err := db.SaveEvent(e); err != nil {
+			t.Fatalf("save event error: %s", err)
+		}
+	}
+
+	all, _ := exportQuery("", "", "", "")
+	buf := &bytes.Buffer{}
+	if n, err := db.ExportEvents(context.Background(), buf, all); err != nil || n != 20 {
+		t.Fatalf("export error: %v, %d", err, n)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 20 {
+		t.Fatalf("invalid number of lines: %d", lines)
+	}
+	data := buf.Bytes()
+	src, _, _ := db.GetEvents(all)
+	if _, err := db.DeleteEvents(all.From, all.To, AnyBucket); err != nil {
+		t.Fatalf("delete events error: %s", err)
+	}
+	db2 := db
+
+	q, err := exportQuery("2017-01-01T05:00:00Z", "", "b1", "even")
+	if err != nil {
+		t.Fatalf("query error: %s", err)
+	}
+	imported, skipped, err := db2.ImportEvents(bytes.NewReader(data), q)
+	// b1 and even: 10, 16
+	if err != nil || imported != 2 || skipped != 18 {
+		t.Fatalf("invalid import result: %d, %d, %v", imported, skipped, err)
+	}
+
+	// full import; imported before events should be replaced
+	for i := 0; i < 2; i++ {
+		imported, skipped, err = db2.ImportEvents(bytes.NewReader(data), all)
+		if err != nil || imported != 20 || skipped != 0 {
+			t.Fatalf("invalid import result: %d, %d, %v", imported, skipped, err)
+		}
+	}
+
+	dst, _, _ := db2.GetEvents(all)
+	if len(src) != len(dst) {
+		t.Fatalf("invalid number of events after import: %d != %d", len(dst), len(src))
+	}
+	for i, e := range src {
+		eventsCompare(e, dst[i], t)
+	}
+
+	_, _, err = db2.ImportEvents(strings.NewReader(string(data[:100])+"\n{}\n"), all)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("invalid error for broken line: %v", err)
+	}
+	_, _, err = db2.ImportEvents(strings.NewReader("\n{\"Time\": 0}\n"), all)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("invalid error for wrong time: %v", err)
+	}
+}
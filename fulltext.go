@@ -0,0 +1,168 @@
+//
+// fulltext.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxTokenLen is max length of token stored in text index; longer tokens
+// are truncated.
+const maxTokenLen = 64
+
+type (
+	// textQueryTerm is single word, prefix (`word*`) or phrase (`"some words"`)
+	textQueryTerm struct {
+		tokens []string
+		// last token is prefix
+		prefix bool
+	}
+
+	// textQuery is list of terms; all must match
+	textQuery []textQueryTerm
+)
+
+// tokenize split text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func indexToken(token string) string {
+	if len(token) > maxTokenLen {
+		return token[:maxTokenLen]
+	}
+	return token
+}
+
+// eventTokens return unique tokens from event title and text
+func eventTokens(e *Event) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, text := range []string{e.Title, e.Text} {
+		for _, token := range tokenize(text) {
+			token = indexToken(token)
+			if !seen[token] {
+				seen[token] = true
+				res = append(res, token)
+			}
+		}
+	}
+	return res
+}
+
+// parseTextQuery parse full text query. Quoted text is phrase, words ending
+// with `*` are prefixes. Words containing separators (ie. `db-primary-3`) are
+// treated as phrases.
+func parseTextQuery(q string) textQuery {
+	var res textQuery
+
+	add := func(text string) {
+		prefix := strings.HasSuffix(text, "*")
+		if tokens := tokenize(text); len(tokens) > 0 {
+			res = append(res, textQueryTerm{tokens: tokens, prefix: prefix})
+		}
+	}
+
+	for len(q) > 0 {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if strings.HasPrefix(q, `"`) {
+			q = q[1:]
+			end := strings.Index(q, `"`)
+			if end < 0 {
+				end = len(q)
+			}
+			add(q[:end])
+			if end < len(q) {
+				end++
+			}
+			q = q[end:]
+			continue
+		}
+		end := strings.IndexFunc(q, unicode.IsSpace)
+		if end < 0 {
+			end = len(q)
+		}
+		add(q[:end])
+		q = q[end:]
+	}
+
+	return res
+}
+
+func (t *textQueryTerm) matchTokens(tokens []string) bool {
+	n := len(t.tokens)
+	for i := 0; i+n <= len(tokens); i++ {
+		match := true
+		for j, tt := range t.tokens {
+			if j == n-1 && t.prefix {
+				match = strings.HasPrefix(tokens[i+j], tt)
+			} else {
+				match = tokens[i+j] == tt
+			}
+			if !match {
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Match check if event title or text contains all query terms
+func (q textQuery) Match(e *Event) bool {
+	title, text := tokenize(e.Title), tokenize(e.Text)
+	for _, t := range q {
+		if !t.matchTokens(title) && !t.matchTokens(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupToken return token used to search term in index and flag if index
+// should be searched by prefix
+func (t *textQueryTerm) lookupToken() (string, bool) {
+	if len(t.tokens) == 1 {
+		token := t.tokens[0]
+		return indexToken(token), t.prefix || len(token) > maxTokenLen
+	}
+	// the longest token (excluding prefix) should be most selective
+	token := ""
+	for i, tt := range t.tokens {
+		if (i < len(t.tokens)-1 || !t.prefix) && len(tt) > len(token) {
+			token = tt
+		}
+	}
+	return indexToken(token), len(token) > maxTokenLen
+}
+
+// scanTextIndex call `fn` for each event containing `token` (or token with
+// given prefix) in time range `f`-`t` from bucket `bname` (or any when nil).
+func scanTextIndex(tx *bolt.Tx, token string, prefix bool, f, t int64, bname []byte,
+	fn func(key, bname []byte) error) error {
+
+	texts := indexSubBucket(tx, textIndexBucket)
+	if texts == nil {
+		return errMissingIndex("text")
+	}
+
+	if !prefix {
+		return scanTermIndex(texts, []byte(token), f, t, bname, fn)
+	}
+
+	return forEachTerm(texts, []byte(token), func(term []byte) error {
+		return scanTermIndex(texts, term, f, t, bname, fn)
+	})
+}
@@ -0,0 +1,65 @@
+//
+// fulltext_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Restart of db-primary-3, (node: Zażółć)\nOK")
+	expected := []string{"restart", "of", "db", "primary", "3", "node", "zażółć", "ok"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("invalid tokens: %v", tokens)
+	}
+}
+
+func TestParseTextQuery(t *testing.T) {
+	q := parseTextQuery(`db-primary-3 "disk full" restart* "unclosed phrase`)
+	expected := textQuery{
+		{tokens: []string{"db", "primary", "3"}},
+		{tokens: []string{"disk", "full"}},
+		{tokens: []string{"restart"}, prefix: true},
+		{tokens: []string{"unclosed", "phrase"}},
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Fatalf("invalid query: %+v", q)
+	}
+}
+
+func TestTextQueryMatch(t *testing.T) {
+	e := &Event{
+		Title: "[firing] Disk full on db-primary-3",
+		Text:  "Restarting postgres\nnode: db-primary-3",
+	}
+
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{"disk", true},
+		{"DISK full", true},
+		{`"disk full"`, true},
+		{`"full disk"`, false},
+		{"db-primary-3", true},
+		{"db-primary-4", false},
+		{"restart*", true},
+		{"restart", false},
+		{"db-prim*", true},
+		{`"on db"`, true},
+		{`"postgres node"`, true},
+		{`"firing postgres"`, false},
+	}
+
+	for _, tc := range tests {
+		if m := parseTextQuery(tc.query).Match(e); m != tc.match {
+			t.Errorf("match %q: %v, expected %v", tc.query, m, tc.match)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+//
+// histogram.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/common/log"
+)
+
+// Grouping of events in histogram
+const (
+	GroupByNone = ""
+	GroupByName = "name"
+	GroupByTag  = "tag"
+)
+
+// maxHistogramSteps limit number of steps in one histogram
+const maxHistogramSteps = 10000
+
+var (
+	// ErrInvalidGroupBy when requested grouping is not supported
+	ErrInvalidGroupBy = errors.New("invalid group by")
+	// ErrInvalidStep when step is not positive or there are too many steps
+	ErrInvalidStep = errors.New("invalid step")
+)
+
+type (
+	// HistogramQuery define criteria for counting events
+	HistogramQuery struct {
+		From time.Time
+		To   time.Time
+		// Step is width of one histogram bin
+		Step time.Duration
+		// Name of bucket; AnyBucket for all buckets
+		Name string
+		// Tags expression; nil for any tags
+		Tags TagExpr
+		// GroupBy is one of GroupByNone, GroupByName, GroupByTag
+		GroupBy string
+	}
+
+	// HistogramSeries is number of events in each step for one group
+	HistogramSeries struct {
+		// Group is bucket name or tag; empty when events are not grouped
+		Group  string
+		Counts []int
+	}
+
+	// Histogram is result of HistogramQuery
+	Histogram struct {
+		From   time.Time
+		Step   time.Duration
+		Series []*HistogramSeries
+	}
+)
+
+// steps return number of bins in histogram
+func (q *HistogramQuery) steps() int {
+	if q.Step <= 0 || q.To.Before(q.From) {
+		return 0
+	}
+	d := q.To.Sub(q.From)
+	if d == math.MaxInt64 {
+		// range too wide for time.Duration
+		return 0
+	}
+	n := d / q.Step
+	if d%q.Step != 0 || n == 0 {
+		n++
+	}
+	if n > maxHistogramSteps {
+		return 0
+	}
+	return int(n)
+}
+
+// Validate query parameters
+func (q *HistogramQuery) Validate() error {
+	if q.To.Before(q.From) {
+		return fmt.Errorf("wrong time range (from > to)")
+	}
+	switch q.GroupBy {
+	case GroupByNone, GroupByName, GroupByTag:
+	default:
+		return ErrInvalidGroupBy
+	}
+	if q.steps() == 0 {
+		return ErrInvalidStep
+	}
+	return nil
+}
+
+// Times return start time of each step
+func (h *Histogram) Times() []time.Time {
+	if len(h.Series) == 0 {
+		return nil
+	}
+	res := make([]time.Time, len(h.Series[0].Counts))
+	for i := range res {
+		res[i] = h.From.Add(time.Duration(i) * h.Step)
+	}
+	return res
+}
+
+// GetHistogram count events started in time range `From` (inclusive) -
+// `To` (exclusive) in `Step` long bins. Events are counted by walking keys in
+// buckets and tag index; events are not decoded.
+func (db *DB) GetHistogram(q HistogramQuery) (*Histogram, error) {
+	log.Debugf("GetHistogram %+v", q)
+
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	hc := newHistogramCounter(&q)
+	f, t := hc.f, hc.t
+
+	err := db.view(func(tx *bolt.Tx) error {
+		var bname []byte
+		if q.Name != AnyBucket {
+			bname = eventBucketName(q.Name)
+		}
+
+		var tags map[string][]string
+		if q.Tags != nil || q.GroupBy == GroupByTag {
+			var err error
+			if tags, err = collectEventsTags(tx, f, t, bname); err != nil {
+				return err
+			}
+		}
+
+		count := func(name []byte, b *bolt.Bucket) error {
+			fkey, _ := marshalTS(f, nil)
+			c := b.Cursor()
+			for k, _ := c.Seek(fkey); k != nil; k, _ = c.Next() {
+				ts, err := unmarshalTS(k)
+				if err != nil || ts >= t {
+					break
+				}
+				var etags []string
+				if tags != nil {
+					etags = tags[string(k)+string(name)]
+				}
+				hc.add(string(name), ts, etags)
+			}
+			return nil
+		}
+
+		if bname == nil {
+			return forEachEventBucket(tx, count)
+		}
+		if b := tx.Bucket(bname); b != nil {
+			return count(bname, b)
+		}
+		log.Infof("unknown bucket name: %v", q.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hc.histogram(), nil
+}
+
+// histogramCounter count events into histogram series
+type histogramCounter struct {
+	q      *HistogramQuery
+	f, t   int64
+	step   int64
+	steps  int
+	series map[string]*HistogramSeries
+}
+
+func newHistogramCounter(q *HistogramQuery) *histogramCounter {
+	hc := &histogramCounter{
+		q:      q,
+		f:      q.From.UnixNano(),
+		t:      q.To.UnixNano(),
+		step:   int64(q.Step),
+		steps:  q.steps(),
+		series: make(map[string]*HistogramSeries),
+	}
+	if q.GroupBy == GroupByNone {
+		hc.series[""] = &HistogramSeries{Counts: make([]int, hc.steps)}
+	}
+	return hc
+}
+
+func (hc *histogramCounter) inc(group string, ts int64) {
+	s, ok := hc.series[group]
+	if !ok {
+		s = &HistogramSeries{Group: group, Counts: make([]int, hc.steps)}
+		hc.series[group] = s
+	}
+	if i := int((ts - hc.f) / hc.step); i < hc.steps {
+		s.Counts[i]++
+	}
+}
+
+// add event from bucket `bname` started at `ts` with `tags` when it match
+// query tags
+func (hc *histogramCounter) add(bname string, ts int64, tags []string) {
+	if ts < hc.f || ts >= hc.t {
+		return
+	}
+	if hc.q.Tags != nil && !hc.q.Tags.Match(tags) {
+		return
+	}
+	switch hc.q.GroupBy {
+	case GroupByName:
+		hc.inc(bname, ts)
+	case GroupByTag:
+		for _, tag := range tags {
+			hc.inc(tag, ts)
+		}
+	default:
+		hc.inc("", ts)
+	}
+}
+
+// histogram return counted series sorted by group
+func (hc *histogramCounter) histogram() *Histogram {
+	h := &Histogram{From: hc.q.From, Step: hc.q.Step}
+	for _, s := range hc.series {
+		h.Series = append(h.Series, s)
+	}
+	sort.Slice(h.Series, func(i, j int) bool {
+		return h.Series[i].Group < h.Series[j].Group
+	})
+	return h
+}
+
+// collectEventsTags load from tag index tags of events started in time range
+// `f`-`t` from bucket `bname` (or any when nil). Result is indexed by event
+// key + bucket name.
+func collectEventsTags(tx *bolt.Tx, f, t int64, bname []byte) (map[string][]string, error) {
+	idx := indexSubBucket(tx, tagIndexBucket)
+	if idx == nil {
+		return nil, errMissingIndex("tag")
+	}
+
+	res := make(map[string][]string)
+	err := forEachTerm(idx, nil, func(term []byte) error {
+		tag := string(term)
+		return scanTermIndex(idx, term, f, t, bname, func(key, kbname []byte) error {
+			lkey := string(key) + string(kbname)
+			res[lkey] = append(res[lkey], tag)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
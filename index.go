@@ -0,0 +1,373 @@
+//
+// index.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	// indexBucket keep all indexes as sub-buckets; it is not an event bucket
+	indexBucket = []byte("__index__")
+	// idIndexBucket map event id into event key + bucket name
+	idIndexBucket = []byte("id")
+	// spanIndexBucket keep longest event duration for each bucket
+	spanIndexBucket = []byte("span")
+	// refIndexBucket map external references (ie. alert fingerprints) into event id
+	refIndexBucket = []byte("ref")
+	// tagIndexBucket keep keys: tag, 0, event key, bucket name
+	tagIndexBucket = []byte("tag")
+	// textIndexBucket keep keys: token, 0, event key, bucket name
+	textIndexBucket = []byte("text")
+)
+
+// eventKeyLen is length of event key (ts + checksum)
+const eventKeyLen = 12
+
+func errMissingIndex(name string) error {
+	return fmt.Errorf("missing %s index", name)
+}
+
+func isEventBucket(name []byte) bool {
+	return !bytes.Equal(name, indexBucket)
+}
+
+// forEachEventBucket call `fn` for every bucket that keep events
+func forEachEventBucket(tx *bolt.Tx, fn func(name []byte, b *bolt.Bucket) error) error {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if !isEventBucket(name) {
+			return nil
+		}
+		return fn(name, b)
+	})
+}
+
+func indexSubBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	idx := tx.Bucket(indexBucket)
+	if idx == nil {
+		return nil
+	}
+	return idx.Bucket(name)
+}
+
+// createIndexes create index buckets if not exists; return true when index
+// buckets were missing and should be rebuild.
+func createIndexes(tx *bolt.Tx) (bool, error) {
+	created := tx.Bucket(indexBucket) == nil
+	idx, err := tx.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range [][]byte{idIndexBucket, spanIndexBucket, refIndexBucket, tagIndexBucket, textIndexBucket} {
+		if idx.Bucket(name) == nil {
+			created = true
+			if _, err := idx.CreateBucket(name); err != nil {
+				return false, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// indexEvent add event `e` stored in bucket `bname` under `key` to indexes
+func indexEvent(tx *bolt.Tx, bname, key []byte, e *Event) error {
+	if span := e.End() - e.Time; span > bucketMaxSpan(tx, bname) {
+		spans := indexSubBucket(tx, spanIndexBucket)
+		if spans == nil {
+			return errMissingIndex("span")
+		}
+		v, _ := marshalTS(span, nil)
+		if err := spans.Put(bname, v); err != nil {
+			return err
+		}
+	}
+
+	if len(e.Tags) > 0 {
+		tags := indexSubBucket(tx, tagIndexBucket)
+		if tags == nil {
+			return errMissingIndex("tag")
+		}
+		for _, tag := range e.Tags {
+			if err := tags.Put(termIndexKey(tag, key, bname), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	texts := indexSubBucket(tx, textIndexBucket)
+	if texts == nil {
+		return errMissingIndex("text")
+	}
+	for _, token := range eventTokens(e) {
+		if err := texts.Put(termIndexKey(token, key, bname), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	if e.ID == "" {
+		return nil
+	}
+	ids := indexSubBucket(tx, idIndexBucket)
+	if ids == nil {
+		return errMissingIndex("id")
+	}
+	v := make([]byte, 0, len(key)+len(bname))
+	v = append(v, key...)
+	v = append(v, bname...)
+	return ids.Put([]byte(e.ID), v)
+}
+
+// unindexEvent remove event `e` stored in bucket `bname` under `key` from indexes
+func unindexEvent(tx *bolt.Tx, bname, key []byte, e *Event) error {
+	if len(e.Tags) > 0 {
+		tags := indexSubBucket(tx, tagIndexBucket)
+		if tags == nil {
+			return errMissingIndex("tag")
+		}
+		for _, tag := range e.Tags {
+			if err := tags.Delete(termIndexKey(tag, key, bname)); err != nil {
+				return err
+			}
+		}
+	}
+
+	texts := indexSubBucket(tx, textIndexBucket)
+	if texts == nil {
+		return errMissingIndex("text")
+	}
+	for _, token := range eventTokens(e) {
+		if err := texts.Delete(termIndexKey(token, key, bname)); err != nil {
+			return err
+		}
+	}
+
+	if e.ID == "" {
+		return nil
+	}
+	ids := indexSubBucket(tx, idIndexBucket)
+	if ids == nil {
+		return errMissingIndex("id")
+	}
+	return ids.Delete([]byte(e.ID))
+}
+
+// termIndexKey build key for term (tag, token) index
+func termIndexKey(term string, key, bname []byte) []byte {
+	k := make([]byte, 0, len(term)+1+len(key)+len(bname))
+	k = append(k, term...)
+	k = append(k, 0)
+	k = append(k, key...)
+	return append(k, bname...)
+}
+
+// scanTermIndex call `fn` for each event with `term` and time in range `f`-`t`
+// (by key) in time order. When `bname` is not nil only events from this bucket
+// are returned.
+func scanTermIndex(idx *bolt.Bucket, term []byte, f, t int64, bname []byte,
+	fn func(key, bname []byte) error) error {
+
+	prefix := append(term[:len(term):len(term)], 0)
+	fkey, _ := marshalTS(f, nil)
+
+	c := idx.Cursor()
+	for k, _ := c.Seek(append(prefix, fkey...)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) < len(prefix)+eventKeyLen {
+			continue
+		}
+		key := k[len(prefix) : len(prefix)+eventKeyLen]
+		if ts, err := unmarshalTS(key); err != nil || ts > t {
+			break
+		}
+		kbname := k[len(prefix)+eventKeyLen:]
+		if bname != nil && !bytes.Equal(bname, kbname) {
+			continue
+		}
+		if err := fn(key, kbname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachTerm call `fn` for each distinct term (tag, token) in index `idx`
+// that starts with `prefix`
+func forEachTerm(idx *bolt.Bucket, prefix []byte, fn func(term []byte) error) error {
+	c := idx.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); {
+		sep := bytes.IndexByte(k, 0)
+		if sep < 0 {
+			k, _ = c.Next()
+			continue
+		}
+		term := append([]byte(nil), k[:sep]...)
+		if err := fn(term); err != nil {
+			return err
+		}
+		// skip to next term
+		k, _ = c.Seek(append(term, 1))
+	}
+	return nil
+}
+
+// scanTagIndex call `fn` for each event with `tag`; see scanTermIndex
+func scanTagIndex(tx *bolt.Tx, tag string, f, t int64, bname []byte,
+	fn func(key, bname []byte) error) error {
+
+	tags := indexSubBucket(tx, tagIndexBucket)
+	if tags == nil {
+		return errMissingIndex("tag")
+	}
+	return scanTermIndex(tags, []byte(tag), f, t, bname, fn)
+}
+
+// maxSpan return duration of longest event in all buckets
+func maxSpan(tx *bolt.Tx) int64 {
+	var span int64
+	if spans := indexSubBucket(tx, spanIndexBucket); spans != nil {
+		spans.ForEach(func(k, v []byte) error {
+			if s, err := unmarshalTS(v); err == nil && s > span {
+				span = s
+			}
+			return nil
+		})
+	}
+	return span
+}
+
+// bucketMaxSpan return duration of longest event in bucket `bname`
+func bucketMaxSpan(tx *bolt.Tx, bname []byte) int64 {
+	spans := indexSubBucket(tx, spanIndexBucket)
+	if spans == nil {
+		return 0
+	}
+	if v := spans.Get(bname); v != nil {
+		if span, err := unmarshalTS(v); err == nil {
+			return span
+		}
+	}
+	return 0
+}
+
+// updateBucketSpan recompute duration of longest event in bucket `b`. Span
+// index only grow when events are saved, so it must be updated after removing
+// long events, otherwise all range scans of bucket start too early.
+func updateBucketSpan(tx *bolt.Tx, bname []byte, b *bolt.Bucket) error {
+	spans := indexSubBucket(tx, spanIndexBucket)
+	if spans == nil {
+		return errMissingIndex("span")
+	}
+
+	var span int64
+	err := b.ForEach(func(k, v []byte) error {
+		e := &Event{}
+		if err := e.unmarshal(v); err != nil {
+			log.Errorf("ERROR: decode event %v in %s error: %s", k, bname, err)
+		} else if s := e.End() - e.Time; s > span {
+			span = s
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if span == 0 {
+		return spans.Delete(bname)
+	}
+	v, _ := marshalTS(span, nil)
+	return spans.Put(bname, v)
+}
+
+// isLongestEvent check if event `e` from bucket `bname` define bucket span,
+// so span should be updated when event is removed
+func isLongestEvent(tx *bolt.Tx, bname []byte, e *Event) bool {
+	span := e.End() - e.Time
+	return span > 0 && span >= bucketMaxSpan(tx, bname)
+}
+
+// spanStart return time from which events overlapping time range starting at
+// `f` must be searched when longest event last `span`. Keys are compared as
+// unsigned values, so result is never negative.
+func spanStart(f, span int64) int64 {
+	if f -= span; f < 0 {
+		return 0
+	}
+	return f
+}
+
+// lookupEventID find bucket name and key of event with given `id`
+func lookupEventID(tx *bolt.Tx, id string) (bname, key []byte) {
+	ids := indexSubBucket(tx, idIndexBucket)
+	if ids == nil {
+		return nil, nil
+	}
+	v := ids.Get([]byte(id))
+	if len(v) <= eventKeyLen {
+		return nil, nil
+	}
+	return v[eventKeyLen:], v[:eventKeyLen]
+}
+
+// pruneRefs remove references to not existing events
+func pruneRefs(tx *bolt.Tx) (int, error) {
+	refs := indexSubBucket(tx, refIndexBucket)
+	if refs == nil {
+		return 0, nil
+	}
+
+	var keys [][]byte
+	c := refs.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if _, key := lookupEventID(tx, string(v)); key == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range keys {
+		if err := refs.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// rebuildIndexes drop and create from scratch all indexes that can be build
+// from events
+func rebuildIndexes(tx *bolt.Tx) (int, error) {
+	if idx := tx.Bucket(indexBucket); idx != nil {
+		for _, name := range [][]byte{idIndexBucket, spanIndexBucket, tagIndexBucket, textIndexBucket} {
+			if idx.Bucket(name) == nil {
+				continue
+			}
+			if err := idx.DeleteBucket(name); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if _, err := createIndexes(tx); err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	err := forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			e := &Event{}
+			if err := e.unmarshal(v); err != nil {
+				log.Errorf("ERROR: index event %v in %s error: %s", k, name, err)
+				return nil
+			}
+			indexed++
+			return indexEvent(tx, name, k, e)
+		})
+	})
+	return indexed, err
+}
@@ -0,0 +1,215 @@
+//
+// iter.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// Order of returned events
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+var (
+	// ErrInvalidCursor when continuation cursor can't be decoded
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidOrder when requested order is not supported
+	ErrInvalidOrder = errors.New("invalid order")
+)
+
+type eventLocation struct {
+	key   []byte
+	bname []byte
+}
+
+// compare locations by key (time) and bucket name
+func (el *eventLocation) compare(other *eventLocation) int {
+	if c := bytes.Compare(el.key, other.key); c != 0 {
+		return c
+	}
+	return bytes.Compare(el.bname, other.bname)
+}
+
+// encodeCursor create opaque continuation cursor pointing after `loc`
+func encodeCursor(loc *eventLocation) string {
+	buf := make([]byte, 0, len(loc.key)+len(loc.bname))
+	buf = append(buf, loc.key...)
+	buf = append(buf, loc.bname...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeCursor decode cursor created by encodeCursor; return nil for empty cursor
+func decodeCursor(cursor string) (*eventLocation, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) <= eventKeyLen {
+		return nil, ErrInvalidCursor
+	}
+	return &eventLocation{key: buf[:eventKeyLen], bname: buf[eventKeyLen:]}, nil
+}
+
+// locationIterator return events location and raw value in requested order
+type locationIterator interface {
+	next() (*eventLocation, []byte)
+}
+
+// bucketIterator walk over one bucket in range of time
+type bucketIterator struct {
+	c     *bolt.Cursor
+	loc   eventLocation
+	value []byte
+	desc  bool
+	// border (inclusive) ts; for asc it's max ts; for desc - min
+	border int64
+}
+
+// newBucketIterator create iterator over events in bucket `b` that start
+// in `f`-`t` range, placed after `after` location (if not nil)
+func newBucketIterator(b *bolt.Bucket, bname []byte, f, t int64, desc bool,
+	after *eventLocation) *bucketIterator {
+
+	bi := &bucketIterator{
+		c:    b.Cursor(),
+		loc:  eventLocation{bname: bname},
+		desc: desc,
+	}
+
+	var k, v []byte
+	if desc {
+		bi.border = f
+		end, _ := marshalTS(t+1, nil)
+		start := end
+		if after != nil && bytes.Compare(after.key, start) < 0 {
+			start = after.key
+		}
+		if k, v = bi.c.Seek(start); k == nil {
+			k, v = bi.c.Last()
+		}
+		for k != nil {
+			loc := eventLocation{key: k, bname: bname}
+			if bytes.Compare(k, end) < 0 && (after == nil || loc.compare(after) < 0) {
+				break
+			}
+			k, v = bi.c.Prev()
+		}
+	} else {
+		bi.border = t
+		start, _ := marshalTS(f, nil)
+		if after != nil && bytes.Compare(after.key, start) > 0 {
+			start = after.key
+		}
+		for k, v = bi.c.Seek(start); k != nil; k, v = bi.c.Next() {
+			loc := eventLocation{key: k, bname: bname}
+			if after == nil || loc.compare(after) > 0 {
+				break
+			}
+		}
+	}
+
+	bi.set(k, v)
+	return bi
+}
+
+func (bi *bucketIterator) set(k, v []byte) {
+	if k != nil {
+		ts, err := unmarshalTS(k)
+		if err != nil || (bi.desc && ts < bi.border) || (!bi.desc && ts > bi.border) {
+			k, v = nil, nil
+		}
+	}
+	bi.loc.key, bi.value = k, v
+}
+
+func (bi *bucketIterator) next() (*eventLocation, []byte) {
+	if bi.loc.key == nil {
+		return nil, nil
+	}
+	loc := &eventLocation{key: bi.loc.key, bname: bi.loc.bname}
+	value := bi.value
+	if bi.desc {
+		bi.set(bi.c.Prev())
+	} else {
+		bi.set(bi.c.Next())
+	}
+	return loc, value
+}
+
+// mergeIterator merge events from many buckets in global time order
+type mergeIterator struct {
+	iters []*bucketIterator
+	desc  bool
+}
+
+func (mi *mergeIterator) next() (*eventLocation, []byte) {
+	var best *bucketIterator
+	for _, bi := range mi.iters {
+		if bi.loc.key == nil {
+			continue
+		}
+		if best == nil {
+			best = bi
+			continue
+		}
+		c := bi.loc.compare(&best.loc)
+		if (mi.desc && c > 0) || (!mi.desc && c < 0) {
+			best = bi
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.next()
+}
+
+// sliceIterator return events from sorted list of locations
+type sliceIterator struct {
+	tx   *bolt.Tx
+	locs []eventLocation
+}
+
+// newSliceIterator create iterator over sorted (ascending) `locs`,
+// placed after `after` location (if not nil)
+func newSliceIterator(tx *bolt.Tx, locs []eventLocation, desc bool, after *eventLocation) *sliceIterator {
+	if after != nil {
+		filtered := locs[:0]
+		for _, loc := range locs {
+			c := loc.compare(after)
+			if (desc && c < 0) || (!desc && c > 0) {
+				filtered = append(filtered, loc)
+			}
+		}
+		locs = filtered
+	}
+	if desc {
+		for i, j := 0, len(locs)-1; i < j; i, j = i+1, j-1 {
+			locs[i], locs[j] = locs[j], locs[i]
+		}
+	}
+	return &sliceIterator{tx: tx, locs: locs}
+}
+
+func (si *sliceIterator) next() (*eventLocation, []byte) {
+	for len(si.locs) > 0 {
+		loc := &si.locs[0]
+		si.locs = si.locs[1:]
+		if b := si.tx.Bucket(loc.bname); b != nil {
+			if v := b.Get(loc.key); v != nil {
+				return loc, v
+			}
+		}
+	}
+	return nil, nil
+}
@@ -10,8 +10,8 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/Merovius/systemd"
 	"github.com/prometheus/client_golang/prometheus"
@@ -30,6 +30,12 @@ var (
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("eventdb"))
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command [args]]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n%s", commandsUsage)
+	}
 }
 
 func main() {
@@ -40,6 +46,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.NArg() > 0 {
+		c, err := LoadConfiguration(*configFile)
+		if err != nil {
+			log.Fatalf("Error parsing config file: %s", err)
+		}
+		os.Exit(runCommand(c, flag.Args()))
+	}
+
 	systemd.NotifyStatus("starting")
 	systemd.AutoWatchdog()
 
@@ -51,10 +65,11 @@ func main() {
 		log.Fatalf("Error parsing config file: %s", err)
 	}
 
-	db, err := DBOpen(c.DBFile)
+	db, err := OpenStore(c)
 	if err != nil {
 		panic(err)
 	}
+	log.Infof("Using %s storage", c.Storage)
 
 	defer db.Close()
 
@@ -71,24 +86,71 @@ func main() {
 	})
 
 	apiHandler := eventsHandler{Configuration: c, DB: db}
-	http.Handle("/api/v1/event", prometheus.InstrumentHandler("api-v1-event", apiHandler))
+	http.Handle("/api/v1/event", prometheus.InstrumentHandler("api-v1-event", &apiHandler))
+
+	eh := eventByIDHandler{DB: db}
+	http.Handle("/api/v1/event/", http.StripPrefix("/api/v1/event/",
+		prometheus.InstrumentHandler("api-v1-event-id", eh)))
+
+	bh := bulkEventsHandler{Configuration: c, DB: db}
+	http.Handle("/api/v1/events/bulk", prometheus.InstrumentHandler("api-v1-events-bulk", &bh))
+
+	exh := exportHandler{DB: db}
+	http.Handle("/api/v1/events/export", http.StripPrefix("/api/v1/events",
+		prometheus.InstrumentHandler("api-v1-events-export", exh)))
+	http.Handle("/api/v1/events/import", http.StripPrefix("/api/v1/events",
+		prometheus.InstrumentHandler("api-v1-events-import", exh)))
+
+	hsh := histogramHandler{DB: db}
+	http.Handle("/api/v1/event/histogram", prometheus.InstrumentHandler("api-v1-event-histogram", hsh))
 
 	ah := AnnotationHandler{DB: db}
 	http.Handle("/annotations", prometheus.InstrumentHandler("annotations", ah))
 
+	sjh := SimpleJSONHandler{DB: db}
+	for _, path := range []string{"/search", "/query", "/tag-keys", "/tag-values"} {
+		http.Handle(path, prometheus.InstrumentHandler(strings.TrimPrefix(path, "/"), sjh))
+	}
+
+	gah := GrafanaAnnotationsHandler{Configuration: c, DB: db}
+	http.Handle(grafanaAnnotationsPath, prometheus.InstrumentHandler("api-annotations", &gah))
+	http.Handle(grafanaAnnotationsPath+"/", prometheus.InstrumentHandler("api-annotations-id", &gah))
+
+	geh := GraphiteEventsHandler{Configuration: c, DB: db}
+	http.Handle(graphiteEventsPath, prometheus.InstrumentHandler("events", &geh))
+
 	pwh := PromWebHookHandler{Configuration: c, DB: db}
-	http.Handle("/api/v1/promwebhook", prometheus.InstrumentHandler("api-v1-promwebhook", pwh))
+	http.Handle("/api/v1/promwebhook", prometheus.InstrumentHandler("api-v1-promwebhook", &pwh))
 
 	hh := humanEventsHandler{Configuration: c, DB: db}
-	http.Handle("/last", hh)
+	http.Handle("/last", &hh)
 
 	http.Handle("/metrics", promhttp.Handler())
 
 	// database endpoints
-	http.Handle("/db/", http.StripPrefix("/db", db.NewInternalsHandler()))
+	vh := vacuumHandler{Configuration: c, DB: db}
+	http.Handle("/db/vacuum", prometheus.InstrumentHandler("db-vacuum", &vh))
+
+	// bolt-only endpoints and workers
+	var (
+		sw snapshotWorker
+		rh restoreHandler
+		ch compactHandler
+	)
+	if bdb, ok := db.(*DB); ok {
+		sw = snapshotWorker{Configuration: c, DB: bdb}
+		sw.Start()
+
+		http.Handle("/db/", http.StripPrefix("/db", bdb.NewInternalsHandler()))
+		rh = restoreHandler{Configuration: c, DB: bdb}
+		http.Handle("/db/restore", prometheus.InstrumentHandler("db-restore", &rh))
+		ch = compactHandler{Configuration: c, DB: bdb}
+		http.Handle("/db/compact", prometheus.InstrumentHandler("db-compact", &ch))
+	}
 
-	// handle hup for reloading configuration
-	hup := make(chan os.Signal)
+	// handle hup for reloading configuration; handlers are registered by
+	// pointers, so they see new configuration
+	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		for {
@@ -98,9 +160,16 @@ func main() {
 				if newConf, err := LoadConfiguration(*configFile); err == nil {
 					log.Debugf("new configuration: %+v", newConf)
 					apiHandler.Configuration = newConf
-					vw.Configuration = newConf
+					vw.Reload(newConf)
+					sw.Configuration = newConf
 					hh.Configuration = newConf
 					pwh.Configuration = newConf
+					gah.Configuration = newConf
+					geh.Configuration = newConf
+					bh.Configuration = newConf
+					rh.Configuration = newConf
+					vh.Configuration = newConf
+					ch.Configuration = newConf
 					log.Info("configuration reloaded")
 				} else {
 					log.Errorf("reloading configuration err: %s", err)
@@ -133,45 +202,3 @@ func main() {
 	done := make(chan bool)
 	<-done
 }
-
-type vacuumWorker struct {
-	Configuration *Configuration
-	DB            *DB
-}
-
-func (v *vacuumWorker) Start() {
-	deletedCntr := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "eventdb_vacuum_events_deleted_total",
-			Help: "Total number events deleted by vacuum worker",
-		},
-	)
-
-	lastRun := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "eventdb_vacuum_last_run_time_seconds",
-			Help: "Last run of vacuum routine.",
-		},
-	)
-
-	prometheus.MustRegister(deletedCntr)
-	prometheus.MustRegister(lastRun)
-
-	go func() {
-		time.Sleep(1 * time.Minute)
-		for {
-			if v.Configuration.RetentionParsed != nil {
-				to := time.Now().Add(-(*v.Configuration.RetentionParsed))
-				from := time.Time{}
-				if deleted, err := v.DB.DeleteEvents(from, to, AnyBucket); err == nil {
-					log.Infof("vacuum deleted %d to %s", deleted, to)
-					deletedCntr.Add(float64(deleted))
-				} else {
-					log.Errorf("vacuum delete error: %s", err.Error())
-				}
-				lastRun.SetToCurrentTime()
-			}
-			time.Sleep(3 * time.Hour)
-		}
-	}()
-}
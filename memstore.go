@@ -0,0 +1,504 @@
+//
+// memstore.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type (
+	// memEntry is serialized event with its location (key and bucket name)
+	memEntry struct {
+		loc  eventLocation
+		data []byte
+	}
+
+	// MemStore keep events in memory. It use the same keys and ordering as
+	// bolt database, so queries and cursors behave the same way. Events are
+	// lost on close.
+	MemStore struct {
+		mu sync.RWMutex
+		// entries sorted by location
+		entries []memEntry
+		// ids map event id into location
+		ids map[string]eventLocation
+		// refs map external reference into event id
+		refs map[string]string
+		// buckets keep names of all buckets, also empty
+		buckets map[string]bool
+	}
+)
+
+// NewMemStore create empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{
+		ids:     make(map[string]eventLocation),
+		refs:    make(map[string]string),
+		buckets: map[string]bool{string(defaultBucket): true},
+	}
+}
+
+// Close store; all events are discarded
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = nil
+	m.ids = make(map[string]eventLocation)
+	m.refs = make(map[string]string)
+	return nil
+}
+
+// search return index of first entry with location not less than `loc`
+func (m *MemStore) search(loc *eventLocation) int {
+	return sort.Search(len(m.entries), func(i int) bool {
+		return m.entries[i].loc.compare(loc) >= 0
+	})
+}
+
+// find return index of entry with location `loc` or -1
+func (m *MemStore) find(loc *eventLocation) int {
+	if i := m.search(loc); i < len(m.entries) && m.entries[i].loc.compare(loc) == 0 {
+		return i
+	}
+	return -1
+}
+
+// prepare validate and serialize event `e`; assign id when empty
+func (m *MemStore) prepare(e *Event) (memEntry, error) {
+	name := eventBucketName(e.Name)
+	if !isEventBucket(name) {
+		return memEntry{}, fmt.Errorf("invalid event name: %q", e.Name)
+	}
+
+	if e.ID == "" {
+		e.ID = newEventID(e.Time)
+	}
+
+	data, key, err := e.marshal()
+	if err != nil {
+		return memEntry{}, err
+	}
+
+	return memEntry{loc: eventLocation{key: key, bname: name}, data: data}, nil
+}
+
+func (m *MemStore) put(e *Event) error {
+	entry, err := m.prepare(e)
+	if err != nil {
+		return err
+	}
+	m.insert(e.ID, entry)
+	return nil
+}
+
+// insert prepared entry of event `id`
+func (m *MemStore) insert(id string, entry memEntry) {
+	i := m.search(&entry.loc)
+	for i < len(m.entries) && m.entries[i].loc.compare(&entry.loc) == 0 {
+		nextEventKey(entry.loc.key)
+		i = m.search(&entry.loc)
+	}
+	m.entries = append(m.entries, memEntry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = entry
+
+	m.buckets[string(entry.loc.bname)] = true
+	m.ids[id] = entry.loc
+}
+
+// remove entry at index `i`
+func (m *MemStore) remove(i int) {
+	e := &Event{}
+	if err := e.unmarshal(m.entries[i].data); err == nil {
+		delete(m.ids, e.ID)
+	}
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+}
+
+// get find event by `id`; return event and index of its entry
+func (m *MemStore) get(id string) (*Event, int, error) {
+	loc, ok := m.ids[id]
+	if !ok {
+		return nil, -1, ErrEventNotFound
+	}
+	i := m.find(&loc)
+	if i < 0 {
+		return nil, -1, ErrEventNotFound
+	}
+	e := &Event{}
+	if err := e.unmarshal(m.entries[i].data); err != nil {
+		return nil, -1, err
+	}
+	return e, i, nil
+}
+
+// SaveEvent to store
+func (m *MemStore) SaveEvent(e *Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.put(e)
+}
+
+// SaveEvents store all events `events`; when any event is invalid, none is
+// stored
+func (m *MemStore) SaveEvents(events []*Event) error {
+	entries := make([]memEntry, 0, len(events))
+	for _, e := range events {
+		entry, err := m.prepare(e)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, entry := range entries {
+		m.insert(events[i].ID, entry)
+	}
+	return nil
+}
+
+// GetEvent find event by `id`
+func (m *MemStore) GetEvent(id string) (*Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, _, err := m.get(id)
+	return e, err
+}
+
+// UpdateEvent find event by `id` and apply changes by `update` function.
+// Return updated event.
+func (m *MemStore) UpdateEvent(id string, update func(e *Event) error) (*Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, i, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(e); err != nil {
+		return nil, err
+	}
+	// id can't be changed
+	e.ID = id
+
+	m.remove(i)
+	return e, m.put(e)
+}
+
+// UpsertEvent save event `e` or replace event previously saved with the same
+// external reference `ref`. Return true when new event was created.
+func (m *MemStore) UpsertEvent(ref []byte, e *Event) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, ok := m.refs[string(ref)]; ok {
+		if _, i, err := m.get(id); err == nil {
+			m.remove(i)
+			e.ID = id
+			return false, m.put(e)
+		} else if err != ErrEventNotFound {
+			return false, err
+		}
+	}
+
+	e.ID = ""
+	if err := m.put(e); err != nil {
+		return false, err
+	}
+	m.refs[string(ref)] = e.ID
+	return true, nil
+}
+
+// DeleteEvent find and delete event by `id`
+func (m *MemStore) DeleteEvent(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, i, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	m.remove(i)
+	return nil
+}
+
+// pruneRefs remove references to not existing events
+func (m *MemStore) pruneRefs() {
+	for ref, id := range m.refs {
+		if _, ok := m.ids[id]; !ok {
+			delete(m.refs, ref)
+		}
+	}
+}
+
+// DeleteEvents started in time range `from`-`to` from bucket `name`
+func (m *MemStore) DeleteEvents(from, to time.Time, name string) (int, error) {
+	f, t := from.UnixNano(), to.UnixNano()
+	var bname []byte
+	if name != AnyBucket {
+		bname = eventBucketName(name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	entries := m.entries[:0]
+	for _, entry := range m.entries {
+		ts, err := unmarshalTS(entry.loc.key)
+		if err == nil && ts >= f && ts <= t && (bname == nil || bytes.Equal(bname, entry.loc.bname)) {
+			e := &Event{}
+			if err := e.unmarshal(entry.data); err == nil {
+				delete(m.ids, e.ID)
+			}
+			deleted++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	m.entries = entries
+	m.pruneRefs()
+
+	return deleted, nil
+}
+
+// memIterator return entries in requested order
+type memIterator struct {
+	entries []memEntry
+	desc    bool
+}
+
+func (mi *memIterator) next() (*eventLocation, []byte) {
+	if len(mi.entries) == 0 {
+		return nil, nil
+	}
+	var entry memEntry
+	if mi.desc {
+		entry = mi.entries[len(mi.entries)-1]
+		mi.entries = mi.entries[:len(mi.entries)-1]
+	} else {
+		entry = mi.entries[0]
+		mi.entries = mi.entries[1:]
+	}
+	return &entry.loc, entry.data
+}
+
+// IterEvents call `fn` for each event matching query `q`; see DB.IterEvents.
+func (m *MemStore) IterEvents(ctx context.Context, q Query, fn func(*Event) error) (string, error) {
+	log.Debugf("MemStore.IterEvents %+v", q)
+
+	if err := q.Validate(); err != nil {
+		return "", err
+	}
+
+	after, _ := decodeCursor(q.Cursor)
+	desc := q.Order == OrderDesc
+	qf := newQueryFilter(&q)
+	var bname []byte
+	if q.Name != AnyBucket {
+		bname = eventBucketName(q.Name)
+	}
+
+	// entries data is never modified, so copied entries can be used after
+	// unlock
+	m.mu.RLock()
+	var entries []memEntry
+	for _, entry := range m.entries {
+		ts, err := unmarshalTS(entry.loc.key)
+		if err != nil || ts > qf.t {
+			continue
+		}
+		if bname != nil && !bytes.Equal(bname, entry.loc.bname) {
+			continue
+		}
+		if after != nil {
+			c := entry.loc.compare(after)
+			if (desc && c >= 0) || (!desc && c <= 0) {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	m.mu.RUnlock()
+
+	it := &memIterator{entries: entries, desc: desc}
+	return iterQuery(ctx, it, &q, qf, fn)
+}
+
+// GetEvents according to query `q`; see DB.GetEvents.
+func (m *MemStore) GetEvents(q Query) ([]*Event, string, error) {
+	var events []*Event
+	next, err := m.IterEvents(context.Background(), q, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, next, err
+}
+
+// GetHistogram count events started in time range `From` (inclusive) -
+// `To` (exclusive) in `Step` long bins.
+func (m *MemStore) GetHistogram(q HistogramQuery) (*Histogram, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	var bname []byte
+	if q.Name != AnyBucket {
+		bname = eventBucketName(q.Name)
+	}
+
+	hc := newHistogramCounter(&q)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, entry := range m.entries {
+		if bname != nil && !bytes.Equal(bname, entry.loc.bname) {
+			continue
+		}
+		e := &Event{}
+		if err := e.unmarshal(entry.data); err != nil {
+			return nil, err
+		}
+		hc.add(string(entry.loc.bname), e.Time, e.Tags)
+	}
+
+	return hc.histogram(), nil
+}
+
+// GetNames return names of all buckets
+func (m *MemStore) GetNames() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.buckets))
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetTags return all tags used by events
+func (m *MemStore) GetTags() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var tags []string
+	for _, entry := range m.entries {
+		e := &Event{}
+		if err := e.unmarshal(entry.data); err != nil {
+			return nil, err
+		}
+		for _, tag := range e.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// ExportEvents write events matching query `q` into `w` as JSON Lines
+func (m *MemStore) ExportEvents(ctx context.Context, w io.Writer, q Query) (int, error) {
+	return exportEvents(ctx, m, w, q)
+}
+
+// ImportEvents read events in JSON Lines format; see DB.ImportEvents.
+func (m *MemStore) ImportEvents(r io.Reader, q Query) (imported, skipped int, err error) {
+	return importEvents(r, q, func(batch []*Event) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, e := range batch {
+			if e.ID != "" {
+				if _, i, err := m.get(e.ID); err == nil {
+					m.remove(i)
+				}
+			}
+			if err := m.put(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Vacuum remove events older than retention time; see DB.Vacuum.
+func (m *MemStore) Vacuum(c *Configuration, now time.Time, dryRun bool) (*VacuumResult, error) {
+	res := &VacuumResult{
+		DryRun:  dryRun,
+		Deleted: make(map[string]int),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules := make(map[string]retentionRules)
+	count := make(map[string]int)
+	var expired []int
+	for i, entry := range m.entries {
+		bname := string(entry.loc.bname)
+		count[bname]++
+		rr, ok := rules[bname]
+		if !ok {
+			rr = c.bucketRetentionRules(bname)
+			rules[bname] = rr
+		}
+		e := &Event{}
+		if err := e.unmarshal(entry.data); err != nil {
+			return nil, err
+		}
+		if rr.expired(e, now) {
+			res.Deleted[bname]++
+			expired = append(expired, i)
+		}
+	}
+
+	var names []string
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != string(defaultBucket) && count[name] == res.Deleted[name] {
+			res.Dropped = append(res.Dropped, name)
+		}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	for j := len(expired) - 1; j >= 0; j-- {
+		m.remove(expired[j])
+	}
+	for _, name := range res.Dropped {
+		delete(m.buckets, name)
+	}
+	m.pruneRefs()
+
+	return res, nil
+}
@@ -0,0 +1,256 @@
+//
+// retention.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+type (
+	// RetentionRule define how long events from matching buckets (and
+	// optionally with tag) are kept
+	RetentionRule struct {
+		// Name of bucket or glob pattern (ie. `alert*`); empty for any bucket
+		Name string `yaml:"name"`
+		// Tag that event must have; empty for any event
+		Tag string `yaml:"tag"`
+		// Retention time; empty for keep forever
+		Retention string `yaml:"retention"`
+
+		RetentionParsed time.Duration `yaml:"-"`
+	}
+
+	// retentionRules are checked in order; first matching rule is applied
+	retentionRules []RetentionRule
+)
+
+func (r *RetentionRule) validate() error {
+	if _, err := path.Match(r.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %s", r.Name, err)
+	}
+	if r.Retention == "" {
+		r.RetentionParsed = 0
+		return nil
+	}
+	d, err := parseDuration(r.Retention)
+	if err != nil {
+		return fmt.Errorf("parse retention time for %q error: %s", r.Name, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid retention time for %q", r.Name)
+	}
+	r.RetentionParsed = d
+	return nil
+}
+
+func (r *RetentionRule) matchBucket(bname string) bool {
+	if r.Name == "" {
+		return true
+	}
+	m, _ := path.Match(r.Name, bname)
+	return m
+}
+
+func (r *RetentionRule) match(bname string, tags []string) bool {
+	return r.matchBucket(bname) && (r.Tag == "" || tagTerm(r.Tag).Match(tags))
+}
+
+// forBucket return rules that may be applied to events in bucket `bname`;
+// last returned rule match all events from bucket (if any)
+func (rr retentionRules) forBucket(bname string) retentionRules {
+	var res retentionRules
+	for _, r := range rr {
+		if r.matchBucket(bname) {
+			res = append(res, r)
+			if r.Tag == "" {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// retention return retention time for events from bucket `bname` with
+// `tags`; 0 mean no limit
+func (c *Configuration) retention(bname string, tags []string) time.Duration {
+	for _, r := range c.RetentionRules {
+		if r.match(bname, tags) {
+			return r.RetentionParsed
+		}
+	}
+	if c.RetentionParsed != nil {
+		return *c.RetentionParsed
+	}
+	return 0
+}
+
+// bucketRetentionRules return rules for bucket `bname`, including global
+// retention as fallback
+func (c *Configuration) bucketRetentionRules(bname string) retentionRules {
+	rules := retentionRules(c.RetentionRules).forBucket(bname)
+	if len(rules) == 0 || rules[len(rules)-1].Tag != "" {
+		def := RetentionRule{}
+		if c.RetentionParsed != nil {
+			def.RetentionParsed = *c.RetentionParsed
+		}
+		rules = append(rules, def)
+	}
+	return rules
+}
+
+// checkRetention return false when event `e` is older than retention time
+// for its bucket and tags
+func (c *Configuration) checkRetention(e *Event, now time.Time) bool {
+	r := c.retention(string(eventBucketName(e.Name)), e.Tags)
+	return r == 0 || e.Time >= now.Add(-r).UnixNano()
+}
+
+// VacuumResult summarize events deleted (or to delete in dry run) by vacuum
+type VacuumResult struct {
+	DryRun bool
+	// Deleted is number of expired events per bucket
+	Deleted map[string]int
+	// Dropped are names of buckets removed because they are empty
+	Dropped []string
+}
+
+// Total return number of all expired events
+func (v *VacuumResult) Total() int {
+	total := 0
+	for _, n := range v.Deleted {
+		total += n
+	}
+	return total
+}
+
+// Vacuum remove events older than retention time defined in configuration
+// `c` and drop buckets that end up empty (except default bucket). In
+// `dryRun` mode database is not changed.
+func (db *DB) Vacuum(c *Configuration, now time.Time, dryRun bool) (*VacuumResult, error) {
+	res := &VacuumResult{
+		DryRun:  dryRun,
+		Deleted: make(map[string]int),
+	}
+
+	vacuum := func(tx *bolt.Tx) error {
+		var empty [][]byte
+		err := forEachEventBucket(tx, func(name []byte, b *bolt.Bucket) error {
+			keys, err := expiredEventsKeys(b, c.bucketRetentionRules(string(name)), now)
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				res.Deleted[string(name)] = len(keys)
+			}
+			drop := !bytes.Equal(name, defaultBucket) && b.Stats().KeyN == len(keys)
+			if drop {
+				empty = append(empty, append([]byte(nil), name...))
+			}
+			if dryRun {
+				return nil
+			}
+			for _, k := range keys {
+				if err := deleteEvent(tx, b, name, k); err != nil {
+					return err
+				}
+			}
+			if len(keys) > 0 && !drop {
+				return updateBucketSpan(tx, name, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range empty {
+			res.Dropped = append(res.Dropped, string(name))
+			if dryRun {
+				continue
+			}
+			if err := dropEventBucket(tx, name); err != nil {
+				return err
+			}
+		}
+
+		if dryRun {
+			return nil
+		}
+		_, err = pruneRefs(tx)
+		return err
+	}
+
+	var err error
+	if dryRun {
+		err = db.view(vacuum)
+	} else {
+		err = db.update(vacuum)
+	}
+	return res, err
+}
+
+// dropEventBucket remove empty bucket `name` and its span index entry
+func dropEventBucket(tx *bolt.Tx, name []byte) error {
+	if err := tx.DeleteBucket(name); err != nil {
+		return err
+	}
+	if spans := indexSubBucket(tx, spanIndexBucket); spans != nil {
+		return spans.Delete(name)
+	}
+	return nil
+}
+
+// expiredEventsKeys return keys of events in bucket `b` expired according
+// to `rules`
+func expiredEventsKeys(b *bolt.Bucket, rules retentionRules, now time.Time) ([][]byte, error) {
+	// events newer than shortest retention are never deleted
+	var shortest time.Duration
+	for _, r := range rules {
+		if r.RetentionParsed > 0 && (shortest == 0 || r.RetentionParsed < shortest) {
+			shortest = r.RetentionParsed
+		}
+	}
+	if shortest == 0 {
+		return nil, nil
+	}
+	to := now.Add(-shortest).UnixNano() - 1
+
+	keys := getEventsKeyFromBucket(0, to, b)
+	if len(rules) == 1 {
+		// retention not depend on tags
+		return keys, nil
+	}
+
+	var res [][]byte
+	for _, k := range keys {
+		e := &Event{}
+		if err := e.unmarshal(b.Get(k)); err != nil {
+			return nil, err
+		}
+		if rules.expired(e, now) {
+			res = append(res, k)
+		}
+	}
+	return res, nil
+}
+
+// expired check if event `e` is older than retention time of first rule
+// matching its tags; rules must be selected for event bucket (see forBucket)
+func (rr retentionRules) expired(e *Event, now time.Time) bool {
+	for _, r := range rr {
+		if r.Tag == "" || tagTerm(r.Tag).Match(e.Tags) {
+			return r.RetentionParsed > 0 && e.Time < now.Add(-r.RetentionParsed).UnixNano()
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+//
+// retention_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func testRetentionConf(t *testing.T) *Configuration {
+	conf := `
+retention: 90d
+retention_rules:
+  - name: deploy*
+    retention: 730d
+  - name: alerts
+    tag: noisy
+    retention: 14d
+  - name: audit
+`
+	c := &Configuration{}
+	if err := yaml.Unmarshal([]byte(conf), c); err != nil {
+		t.Fatalf("unmarshal config error: %s", err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatalf("validate config error: %s", err)
+	}
+	r, _ := parseDuration(c.Retention)
+	c.RetentionParsed = &r
+	return c
+}
+
+func TestCheckRetention(t *testing.T) {
+	c := testRetentionConf(t)
+	now := time.Now()
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name string
+		tags []string
+		age  time.Duration
+		ok   bool
+	}{
+		{"deploy-prod", nil, 365 * day, true},
+		{"deploy-prod", nil, 800 * day, false},
+		{"alerts", []string{"noisy"}, 10 * day, true},
+		{"alerts", []string{"noisy"}, 20 * day, false},
+		{"alerts", []string{"important"}, 20 * day, true},
+		{"alerts", []string{"important"}, 100 * day, false},
+		{"audit", nil, 10000 * day, true},
+		{"", nil, 100 * day, false},
+	}
+	for i, tc := range tests {
+		e := &Event{Name: tc.name, Tags: tc.tags, Time: now.Add(-tc.age).UnixNano()}
+		if ok := c.checkRetention(e, now); ok != tc.ok {
+			t.Errorf("%d: expected %v for %+v", i, tc.ok, tc)
+		}
+	}
+}
+
+func testVacuum(t *testing.T, db EventStore) {
+	c := testRetentionConf(t)
+	now := time.Now()
+	day := 24 * time.Hour
+
+	events := []*Event{
+		{Name: "deploy", Title: "keep", Time: now.Add(-365 * day).UnixNano()},
+		{Name: "deploy", Title: "delete", Time: now.Add(-800 * day).UnixNano()},
+		{Name: "alerts", Title: "delete", Tags: []string{"noisy"}, Time: now.Add(-20 * day).UnixNano()},
+		{Name: "alerts", Title: "keep", Tags: []string{"important"}, Time: now.Add(-20 * day).UnixNano()},
+		{Name: "audit", Title: "keep", Time: now.Add(-1000 * day).UnixNano()},
+		{Title: "delete", Time: now.Add(-100 * day).UnixNano()},
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+
+	res, err := db.Vacuum(c, now, false)
+	if err != nil {
+		t.Fatalf("vacuum error: %s", err)
+	}
+	if deleted := res.Total(); deleted != 3 {
+		t.Errorf("expected 3 deleted events, got %d", deleted)
+	}
+	for _, e := range events {
+		_, err := db.GetEvent(e.ID)
+		if e.Title == "keep" && err != nil {
+			t.Errorf("event %+v should be kept: %s", e, err)
+		} else if e.Title == "delete" && err != ErrEventNotFound {
+			t.Errorf("event %+v should be deleted: %v", e, err)
+		}
+	}
+}
+
+func testVacuumDryRunDropBuckets(t *testing.T, db EventStore) {
+	c := testRetentionConf(t)
+	now := time.Now()
+	day := 24 * time.Hour
+
+	events := []*Event{
+		{Name: "alerts", Tags: []string{"noisy"}, Time: now.Add(-20 * day).UnixNano()},
+		{Name: "alerts", Tags: []string{"noisy"}, Time: now.Add(-30 * day).UnixNano()},
+		{Name: "deploy", Time: now.Add(-800 * day).UnixNano()},
+		{Name: "deploy", Time: now.Add(-day).UnixNano()},
+		{Time: now.Add(-100 * day).UnixNano()},
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+
+	expected := map[string]int{"alerts": 2, "deploy": 1, "__default__": 1}
+	for _, dryRun := range []bool{true, false} {
+		res, err := db.Vacuum(c, now, dryRun)
+		if err != nil {
+			t.Fatalf("vacuum (%v) error: %s", dryRun, err)
+		}
+		if !reflect.DeepEqual(res.Deleted, expected) {
+			t.Errorf("vacuum (%v): expected %v, got %v", dryRun, expected, res.Deleted)
+		}
+		if !reflect.DeepEqual(res.Dropped, []string{"alerts"}) {
+			t.Errorf("vacuum (%v): expected dropped alerts, got %v", dryRun, res.Dropped)
+		}
+
+		names, err := db.GetNames()
+		if err != nil {
+			t.Fatalf("get names error: %s", err)
+		}
+		expNames := []string{"__default__", "deploy"}
+		if dryRun {
+			expNames = []string{"__default__", "alerts", "deploy"}
+		}
+		if !reflect.DeepEqual(names, expNames) {
+			t.Errorf("vacuum (%v): expected buckets %v, got %v", dryRun, expNames, names)
+		}
+	}
+}
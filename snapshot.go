@@ -0,0 +1,241 @@
+//
+// snapshot.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	snapshotTimeFormat = "20060102T150405Z"
+	snapshotExt        = ".boltdb"
+	snapshotGzipExt    = ".gz"
+)
+
+var (
+	snapshotLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "eventdb_snapshot_last_success_time_seconds",
+			Help: "Time of last successful snapshot.",
+		},
+	)
+	snapshotSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "eventdb_snapshot_size_bytes",
+			Help: "Size of last snapshot file.",
+		},
+	)
+	snapshotFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "eventdb_snapshot_failures_total",
+			Help: "Total number of failed snapshots.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(snapshotLastSuccess)
+	prometheus.MustRegister(snapshotSize)
+	prometheus.MustRegister(snapshotFailures)
+}
+
+// snapshotCheckInterval is how often worker check if snapshot is due, so
+// changes of configuration are applied without restart
+const snapshotCheckInterval = time.Minute
+
+type snapshotWorker struct {
+	Configuration *Configuration
+	DB            *DB
+}
+
+// Start snapshot worker; snapshot is created when configured interval
+// passed since the newest snapshot in snapshot directory (or since last
+// failed attempt), so restarts don't postpone snapshots
+func (s *snapshotWorker) Start() {
+	go func() {
+		var lastTry time.Time
+		for {
+			conf := s.Configuration.Snapshot
+			now := time.Now()
+			if conf.Dir != "" && snapshotDue(&conf, s.DB.snapshotPrefix(), lastTry, now) {
+				lastTry = now
+				if name, err := s.DB.Snapshot(&conf, now); err == nil {
+					log.Infof("snapshot %s created", name)
+				} else {
+					log.Errorf("snapshot error: %s", err.Error())
+				}
+			}
+			time.Sleep(snapshotCheckInterval)
+		}
+	}()
+}
+
+// snapshotDue check if interval passed since the newest snapshot with
+// `prefix` and since `lastTry`
+func snapshotDue(conf *SnapshotConf, prefix string, lastTry, now time.Time) bool {
+	last := lastSnapshotTime(conf.Dir, prefix)
+	if lastTry.After(last) {
+		last = lastTry
+	}
+	return !now.Before(last.Add(conf.IntervalParsed))
+}
+
+// lastSnapshotTime return time of the newest snapshot with `prefix` in `dir`;
+// zero when there is no snapshot
+func lastSnapshotTime(dir, prefix string) time.Time {
+	names, err := listSnapshots(dir, prefix)
+	if err != nil || len(names) == 0 {
+		return time.Time{}
+	}
+	name := strings.TrimPrefix(names[len(names)-1], prefix)
+	if len(name) < len(snapshotTimeFormat) {
+		return time.Time{}
+	}
+	ts, err := time.Parse(snapshotTimeFormat, name[:len(snapshotTimeFormat)])
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
+// Snapshot write copy of database into snapshot directory and remove old
+// snapshots; return name of created file
+func (db *DB) Snapshot(conf *SnapshotConf, now time.Time) (string, error) {
+	name, size, err := db.writeSnapshot(conf, now)
+	if err != nil {
+		snapshotFailures.Inc()
+		return "", err
+	}
+	snapshotLastSuccess.SetToCurrentTime()
+	snapshotSize.Set(float64(size))
+
+	if err := rotateSnapshots(conf, db.snapshotPrefix()); err != nil {
+		log.Errorf("remove old snapshots error: %s", err.Error())
+	}
+	return name, nil
+}
+
+// snapshotPrefix is base name of database file without extension
+func (db *DB) snapshotPrefix() string {
+	base := filepath.Base(db.dbFilename)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+func (db *DB) writeSnapshot(conf *SnapshotConf, now time.Time) (string, int64, error) {
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return "", 0, err
+	}
+
+	name := db.snapshotPrefix() + now.UTC().Format(snapshotTimeFormat) + snapshotExt
+	if conf.Compress {
+		name += snapshotGzipExt
+	}
+	name = filepath.Join(conf.Dir, name)
+
+	// write into temporary file, so incomplete snapshots are never kept
+	f, err := ioutil.TempFile(conf.Dir, ".snapshot")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpname := f.Name()
+
+	var w io.Writer = f
+	var gw *gzip.Writer
+	if conf.Compress {
+		gw = gzip.NewWriter(f)
+		w = gw
+	}
+
+	err = db.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err == nil && gw != nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, name)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return "", 0, err
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return name, 0, err
+	}
+	return name, fi.Size(), nil
+}
+
+// listSnapshots return names of snapshots with `prefix` in `dir` from oldest
+func listSnapshots(dir, prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasSuffix(name, snapshotExt) || strings.HasSuffix(name, snapshotExt+snapshotGzipExt) {
+			res = append(res, name)
+		}
+	}
+	// names contain timestamp, so are sorted by time
+	sort.Strings(res)
+	return res, nil
+}
+
+// rotateSnapshots remove the oldest snapshots above limit
+func rotateSnapshots(conf *SnapshotConf, prefix string) error {
+	names, err := listSnapshots(conf.Dir, prefix)
+	if err != nil {
+		return err
+	}
+	for len(names) > conf.Keep {
+		if err := os.Remove(filepath.Join(conf.Dir, names[0])); err != nil {
+			return err
+		}
+		log.Debugf("snapshot %s removed", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// maybeGunzip return reader that decompress `r` when it is gzipped
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// too short data are rejected by validation
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
@@ -0,0 +1,111 @@
+//
+// snapshot_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRotation(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	e := &Event{Name: "test", Title: "snapshot", Time: 1000}
+	if err := db.SaveEvent(e); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "eventdb-snapshots")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &SnapshotConf{Dir: dir, Keep: 2, Compress: true}
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	var last string
+	for i := 0; i < 3; i++ {
+		if last, err = db.Snapshot(conf, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("snapshot error: %s", err)
+		}
+	}
+
+	names, err := listSnapshots(dir, db.snapshotPrefix())
+	if err != nil {
+		t.Fatalf("list snapshots error: %s", err)
+	}
+	expected := []string{
+		"test-20171001T130000Z.boltdb.gz",
+		"test-20171001T140000Z.boltdb.gz",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if filepath.Base(last) != expected[1] {
+		t.Errorf("expected last snapshot %s, got %s", expected[1], last)
+	}
+
+	// compressed snapshot can be restored
+	f, err := os.Open(last)
+	if err != nil {
+		t.Fatalf("open snapshot error: %s", err)
+	}
+	defer f.Close()
+	if err := db.DeleteEvent(e.ID); err != nil {
+		t.Fatalf("delete event error: %s", err)
+	}
+	if err := db.Restore(f); err != nil {
+		t.Fatalf("restore error: %s", err)
+	}
+	if _, err := db.GetEvent(e.ID); err != nil {
+		t.Errorf("get restored event error: %s", err)
+	}
+}
+
+func TestSnapshotDue(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "eventdb-snapshots")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &SnapshotConf{Dir: dir, Keep: 2, IntervalParsed: 6 * time.Hour}
+	prefix := db.snapshotPrefix()
+	start := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// first snapshot is created immediately
+	if !snapshotDue(conf, prefix, time.Time{}, start) {
+		t.Errorf("snapshot expected when there is no snapshot")
+	}
+	if _, err := db.Snapshot(conf, start); err != nil {
+		t.Fatalf("snapshot error: %s", err)
+	}
+	if ts := lastSnapshotTime(dir, prefix); !ts.Equal(start) {
+		t.Errorf("invalid last snapshot time: %v", ts)
+	}
+
+	// after restart next snapshot is created interval after the last one
+	if snapshotDue(conf, prefix, time.Time{}, start.Add(5*time.Hour)) {
+		t.Errorf("snapshot not expected before interval")
+	}
+	if !snapshotDue(conf, prefix, time.Time{}, start.Add(6*time.Hour)) {
+		t.Errorf("snapshot expected after interval")
+	}
+	// failed snapshot is retried after interval
+	if snapshotDue(conf, prefix, start.Add(6*time.Hour), start.Add(7*time.Hour)) {
+		t.Errorf("snapshot not expected after failed attempt")
+	}
+}
@@ -0,0 +1,700 @@
+//
+// sqlitestore.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	// sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/common/log"
+)
+
+// sqliteSchema create tables and indexes for events.
+//
+// Events are stored in `events` table; `key` is the same as key in bolt
+// database (start time + checksum) and together with bucket name define order
+// of events. Tags are kept in `event_tags` in original order. `buckets` keep
+// names of all buckets (also empty) and longest event duration in bucket;
+// `event_refs` map external references (ie. alert fingerprints) into event id.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS buckets (
+	name TEXT NOT NULL PRIMARY KEY,
+	max_span INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS events (
+	id TEXT NOT NULL PRIMARY KEY,
+	bucket TEXT NOT NULL REFERENCES buckets(name),
+	key BLOB NOT NULL,
+	name TEXT NOT NULL,
+	title TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	time_end INTEGER NOT NULL,
+	text TEXT NOT NULL,
+	dashboard_uid TEXT NOT NULL,
+	panel_id INTEGER NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS events_key ON events(key, bucket);
+CREATE INDEX IF NOT EXISTS events_bucket_key ON events(bucket, key);
+CREATE INDEX IF NOT EXISTS events_time ON events(time);
+CREATE TABLE IF NOT EXISTS event_tags (
+	event_id TEXT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+	pos INTEGER NOT NULL,
+	tag TEXT NOT NULL,
+	PRIMARY KEY (event_id, pos)
+);
+CREATE INDEX IF NOT EXISTS event_tags_tag ON event_tags(tag, event_id);
+CREATE TABLE IF NOT EXISTS event_refs (
+	ref BLOB NOT NULL PRIMARY KEY,
+	event_id TEXT NOT NULL
+);
+`
+
+// sqlEventColumns are columns loaded by scanSQLEvent
+const sqlEventColumns = `e.id, e.name, e.title, e.time, e.time_end, e.text,
+	e.dashboard_uid, e.panel_id, e.key, e.bucket,
+	(SELECT json_group_array(tag) FROM
+		(SELECT t.tag FROM event_tags t WHERE t.event_id = e.id ORDER BY t.pos))`
+
+// SQLiteStore keep events in SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+	// mu serialize write transactions
+	mu sync.Mutex
+}
+
+// OpenSQLiteStore open or create SQLite database `filename`
+func OpenSQLiteStore(filename string) (*SQLiteStore, error) {
+	log.Infof("OpenSQLiteStore %s", filename)
+
+	dsn := "file:" + filename + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=1"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema error: %s", err)
+	}
+
+	s := &SQLiteStore{db: db}
+	err = s.update(func(tx *sql.Tx) error {
+		return ensureSQLBucket(tx, string(defaultBucket), 0)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// update run `fn` in write transaction
+func (s *SQLiteStore) update(fn func(tx *sql.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlScanner is implemented by sql.Row and sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSQLEvent load event from row with sqlEventColumns
+func scanSQLEvent(row sqlScanner) (*eventLocation, *Event, error) {
+	e := &Event{}
+	loc := &eventLocation{}
+	var tags string
+	err := row.Scan(&e.ID, &e.Name, &e.Title, &e.Time, &e.TimeEnd, &e.Text,
+		&e.DashboardUID, &e.PanelID, &loc.key, &loc.bname, &tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &e.Tags); err != nil {
+		return nil, nil, err
+	}
+	if len(e.Tags) == 0 {
+		e.Tags = nil
+	}
+	return loc, e, nil
+}
+
+// ensureSQLBucket create bucket `name` when not exists and update its
+// longest event duration
+func ensureSQLBucket(tx *sql.Tx, name string, span int64) error {
+	_, err := tx.Exec(`INSERT INTO buckets(name, max_span) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET max_span = max(max_span, excluded.max_span)`,
+		name, span)
+	return err
+}
+
+// putSQLEvent store event; event with the same id is replaced
+func putSQLEvent(tx *sql.Tx, e *Event) error {
+	name := eventBucketName(e.Name)
+	if !isEventBucket(name) {
+		return fmt.Errorf("invalid event name: %q", e.Name)
+	}
+
+	if e.ID == "" {
+		e.ID = newEventID(e.Time)
+	}
+
+	_, key, err := e.marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureSQLBucket(tx, string(name), e.End()-e.Time); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM events WHERE id = ?`, e.ID); err != nil {
+		return err
+	}
+	for {
+		var found int
+		err := tx.QueryRow(`SELECT count(*) FROM events WHERE key = ? AND bucket = ?`,
+			key, string(name)).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			break
+		}
+		nextEventKey(key)
+	}
+
+	_, err = tx.Exec(`INSERT INTO events(id, bucket, key, name, title, time,
+		time_end, text, dashboard_uid, panel_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, string(name), key, e.Name, e.Title, e.Time, e.TimeEnd, e.Text,
+		e.DashboardUID, e.PanelID)
+	if err != nil {
+		return err
+	}
+
+	for i, tag := range e.Tags {
+		_, err := tx.Exec(`INSERT INTO event_tags(event_id, pos, tag) VALUES (?, ?, ?)`,
+			e.ID, i, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlQueryRower is implemented by sql.DB and sql.Tx
+type sqlQueryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getSQLEvent find event by `id`
+func getSQLEvent(db sqlQueryRower, id string) (*Event, error) {
+	row := db.QueryRow(`SELECT `+sqlEventColumns+` FROM events e WHERE e.id = ?`, id)
+	_, e, err := scanSQLEvent(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrEventNotFound
+	}
+	return e, err
+}
+
+// updateSQLBucketSpan recompute duration of longest event in bucket `name`
+// or in all buckets when `name` is empty; see updateBucketSpan.
+func updateSQLBucketSpan(tx *sql.Tx, name string) error {
+	query := `UPDATE buckets SET max_span = coalesce(
+		(SELECT max(max(e.time, e.time_end) - e.time) FROM events e
+		WHERE e.bucket = buckets.name), 0)`
+	var args []interface{}
+	if name != "" {
+		query += ` WHERE name = ?`
+		args = append(args, name)
+	}
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+// pruneSQLRefs remove references to not existing events
+func pruneSQLRefs(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM event_refs
+		WHERE event_id NOT IN (SELECT id FROM events)`)
+	return err
+}
+
+// SaveEvent to database
+func (s *SQLiteStore) SaveEvent(e *Event) error {
+	return s.update(func(tx *sql.Tx) error {
+		return putSQLEvent(tx, e)
+	})
+}
+
+// SaveEvents store all events `events` in one transaction
+func (s *SQLiteStore) SaveEvents(events []*Event) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, e := range events {
+			if err := putSQLEvent(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetEvent find event by `id`
+func (s *SQLiteStore) GetEvent(id string) (*Event, error) {
+	return getSQLEvent(s.db, id)
+}
+
+// UpdateEvent find event by `id` and apply changes by `update` function.
+// Return updated event.
+func (s *SQLiteStore) UpdateEvent(id string, update func(e *Event) error) (*Event, error) {
+	var e *Event
+	err := s.update(func(tx *sql.Tx) error {
+		var err error
+		if e, err = getSQLEvent(tx, id); err != nil {
+			return err
+		}
+		// event after update may be shorter or moved to other bucket
+		bname := string(eventBucketName(e.Name))
+		if err := update(e); err != nil {
+			return err
+		}
+		// id can't be changed
+		e.ID = id
+		if err := putSQLEvent(tx, e); err != nil {
+			return err
+		}
+		return updateSQLBucketSpan(tx, bname)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// UpsertEvent save event `e` or replace event previously saved with the same
+// external reference `ref`. Return true when new event was created.
+func (s *SQLiteStore) UpsertEvent(ref []byte, e *Event) (bool, error) {
+	created := false
+	err := s.update(func(tx *sql.Tx) error {
+		var id string
+		err := tx.QueryRow(`SELECT event_id FROM event_refs WHERE ref = ?`, ref).Scan(&id)
+		switch err {
+		case nil:
+			if prev, err := getSQLEvent(tx, id); err == nil {
+				e.ID = id
+				if err := putSQLEvent(tx, e); err != nil {
+					return err
+				}
+				// new event may be shorter or placed in other bucket
+				return updateSQLBucketSpan(tx, string(eventBucketName(prev.Name)))
+			} else if err != ErrEventNotFound {
+				return err
+			}
+		case sql.ErrNoRows:
+		default:
+			return err
+		}
+
+		e.ID = ""
+		if err := putSQLEvent(tx, e); err != nil {
+			return err
+		}
+		created = true
+		_, err = tx.Exec(`INSERT OR REPLACE INTO event_refs(ref, event_id) VALUES (?, ?)`,
+			ref, e.ID)
+		return err
+	})
+	return created, err
+}
+
+// DeleteEvent find and delete event by `id`
+func (s *SQLiteStore) DeleteEvent(id string) error {
+	return s.update(func(tx *sql.Tx) error {
+		var bname string
+		err := tx.QueryRow(`SELECT bucket FROM events WHERE id = ?`, id).Scan(&bname)
+		if err == sql.ErrNoRows {
+			return ErrEventNotFound
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM events WHERE id = ?`, id); err != nil {
+			return err
+		}
+		return updateSQLBucketSpan(tx, bname)
+	})
+}
+
+// DeleteEvents started in time range `from`-`to` from bucket `name`
+func (s *SQLiteStore) DeleteEvents(from, to time.Time, name string) (int, error) {
+	query := `DELETE FROM events WHERE time >= ? AND time <= ?`
+	args := []interface{}{from.UnixNano(), to.UnixNano()}
+	if name != AnyBucket {
+		query += ` AND bucket = ?`
+		args = append(args, string(eventBucketName(name)))
+	}
+
+	deleted := 0
+	err := s.update(func(tx *sql.Tx) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted = int(n)
+		bname := ""
+		if name != AnyBucket {
+			bname = string(eventBucketName(name))
+		}
+		if err := updateSQLBucketSpan(tx, bname); err != nil {
+			return err
+		}
+		return pruneSQLRefs(tx)
+	})
+	return deleted, err
+}
+
+// IterEvents call `fn` for each event matching query `q`; see DB.IterEvents.
+// Time range, bucket, tags (when possible), dashboard and panel are checked
+// by database; remaining criteria are checked by query filter.
+func (s *SQLiteStore) IterEvents(ctx context.Context, q Query, fn func(*Event) error) (string, error) {
+	log.Debugf("SQLiteStore.IterEvents %+v", q)
+
+	if err := q.Validate(); err != nil {
+		return "", err
+	}
+
+	after, _ := decodeCursor(q.Cursor)
+	desc := q.Order == OrderDesc
+	qf := newQueryFilter(&q)
+
+	// read transaction give consistent view of data
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var where []string
+	var args []interface{}
+
+	spanQuery := `SELECT coalesce(max(max_span), 0) FROM buckets`
+	var spanArgs []interface{}
+	if q.Name != AnyBucket {
+		bname := string(eventBucketName(q.Name))
+		where = append(where, `e.bucket = ?`)
+		args = append(args, bname)
+		spanQuery += ` WHERE name = ?`
+		spanArgs = append(spanArgs, bname)
+	}
+
+	var span int64
+	if err := tx.QueryRow(spanQuery, spanArgs...).Scan(&span); err != nil {
+		return "", err
+	}
+
+	// region events started before `f` may overlap range; range of keys
+	// allow to use index ordered like results
+	start, _ := marshalTS(spanStart(qf.f, span), nil)
+	end, _ := marshalTS(qf.t+1, nil)
+	where = append(where, `e.key >= ?`, `e.key < ?`, `e.time <= ?`,
+		`max(e.time, e.time_end) >= ?`)
+	args = append(args, start, end, qf.t, qf.f)
+
+	if tags := indexTags(q.Tags); tags != nil {
+		where = append(where, `e.id IN (SELECT event_id FROM event_tags WHERE tag IN (?`+
+			strings.Repeat(`, ?`, len(tags)-1)+`))`)
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	if q.DashboardUID != "" {
+		where = append(where, `e.dashboard_uid = ?`)
+		args = append(args, q.DashboardUID)
+	}
+	if q.PanelID != 0 {
+		where = append(where, `e.panel_id = ?`)
+		args = append(args, q.PanelID)
+	}
+
+	order := `e.key, e.bucket`
+	if desc {
+		order = `e.key DESC, e.bucket DESC`
+	}
+	if after != nil {
+		if desc {
+			where = append(where, `(e.key, e.bucket) < (?, ?)`)
+		} else {
+			where = append(where, `(e.key, e.bucket) > (?, ?)`)
+		}
+		args = append(args, after.key, string(after.bname))
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+sqlEventColumns+` FROM events e
+		WHERE `+strings.Join(where, ` AND `)+` ORDER BY `+order, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	next := func() (*eventLocation, *Event, error) {
+		if !rows.Next() {
+			return nil, nil, rows.Err()
+		}
+		return scanSQLEvent(rows)
+	}
+	return iterQueryEvents(ctx, next, &q, qf, fn)
+}
+
+// GetEvents according to query `q`; see DB.GetEvents.
+func (s *SQLiteStore) GetEvents(q Query) ([]*Event, string, error) {
+	var events []*Event
+	next, err := s.IterEvents(context.Background(), q, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, next, err
+}
+
+// GetHistogram count events started in time range `From` (inclusive) -
+// `To` (exclusive) in `Step` long bins.
+func (s *SQLiteStore) GetHistogram(q HistogramQuery) (*Histogram, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + sqlEventColumns + ` FROM events e WHERE e.time >= ? AND e.time < ?`
+	args := []interface{}{q.From.UnixNano(), q.To.UnixNano()}
+	if q.Name != AnyBucket {
+		query += ` AND e.bucket = ?`
+		args = append(args, string(eventBucketName(q.Name)))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hc := newHistogramCounter(&q)
+	for rows.Next() {
+		loc, e, err := scanSQLEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		hc.add(string(loc.bname), e.Time, e.Tags)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hc.histogram(), nil
+}
+
+// queryStrings return all strings returned by `query`
+func (s *SQLiteStore) queryStrings(query string) ([]string, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+// GetNames return names of all buckets
+func (s *SQLiteStore) GetNames() ([]string, error) {
+	return s.queryStrings(`SELECT name FROM buckets ORDER BY name`)
+}
+
+// GetTags return all tags used by events
+func (s *SQLiteStore) GetTags() ([]string, error) {
+	return s.queryStrings(`SELECT DISTINCT tag FROM event_tags ORDER BY tag`)
+}
+
+// ExportEvents write events matching query `q` into `w` as JSON Lines
+func (s *SQLiteStore) ExportEvents(ctx context.Context, w io.Writer, q Query) (int, error) {
+	return exportEvents(ctx, s, w, q)
+}
+
+// ImportEvents read events in JSON Lines format; see DB.ImportEvents.
+func (s *SQLiteStore) ImportEvents(r io.Reader, q Query) (imported, skipped int, err error) {
+	return importEvents(r, q, func(batch []*Event) error {
+		return s.update(func(tx *sql.Tx) error {
+			for _, e := range batch {
+				if err := putSQLEvent(tx, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Vacuum remove events older than retention time; see DB.Vacuum.
+func (s *SQLiteStore) Vacuum(c *Configuration, now time.Time, dryRun bool) (*VacuumResult, error) {
+	res := &VacuumResult{
+		DryRun:  dryRun,
+		Deleted: make(map[string]int),
+	}
+
+	err := s.update(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + sqlEventColumns + ` FROM events e ORDER BY e.bucket`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		rules := make(map[string]retentionRules)
+		count := make(map[string]int)
+		var expired []string
+		for rows.Next() {
+			loc, e, err := scanSQLEvent(rows)
+			if err != nil {
+				return err
+			}
+			bname := string(loc.bname)
+			count[bname]++
+			rr, ok := rules[bname]
+			if !ok {
+				rr = c.bucketRetentionRules(bname)
+				rules[bname] = rr
+			}
+			if rr.expired(e, now) {
+				res.Deleted[bname]++
+				expired = append(expired, e.ID)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		names, err := tx.Query(`SELECT name FROM buckets WHERE name != ? ORDER BY name`,
+			string(defaultBucket))
+		if err != nil {
+			return err
+		}
+		defer names.Close()
+		for names.Next() {
+			var name string
+			if err := names.Scan(&name); err != nil {
+				return err
+			}
+			if count[name] == res.Deleted[name] {
+				res.Dropped = append(res.Dropped, name)
+			}
+		}
+		if err := names.Err(); err != nil {
+			return err
+		}
+		names.Close()
+
+		if dryRun {
+			return nil
+		}
+
+		for _, id := range expired {
+			if _, err := tx.Exec(`DELETE FROM events WHERE id = ?`, id); err != nil {
+				return err
+			}
+		}
+		for _, name := range res.Dropped {
+			if _, err := tx.Exec(`DELETE FROM buckets WHERE name = ?`, name); err != nil {
+				return err
+			}
+		}
+		if err := updateSQLBucketSpan(tx, ""); err != nil {
+			return err
+		}
+		return pruneSQLRefs(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MigrateFromBolt copy all events, buckets and external references from bolt
+// database `db`; events with the same id are replaced. Return number of
+// copied events.
+func (s *SQLiteStore) MigrateFromBolt(db *DB) (int, error) {
+	copied := 0
+	err := db.view(func(btx *bolt.Tx) error {
+		return s.update(func(tx *sql.Tx) error {
+			err := forEachEventBucket(btx, func(name []byte, b *bolt.Bucket) error {
+				if err := ensureSQLBucket(tx, string(name), 0); err != nil {
+					return err
+				}
+				return b.ForEach(func(k, v []byte) error {
+					e := &Event{}
+					if err := e.unmarshal(v); err != nil {
+						log.Errorf("ERROR: decode event %v in %s error: %s", k, name, err)
+						return nil
+					}
+					if err := putSQLEvent(tx, e); err != nil {
+						return err
+					}
+					copied++
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			refs := indexSubBucket(btx, refIndexBucket)
+			if refs == nil {
+				return nil
+			}
+			err = refs.ForEach(func(k, v []byte) error {
+				_, err := tx.Exec(`INSERT OR REPLACE INTO event_refs(ref, event_id)
+					VALUES (?, ?)`, k, string(v))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return pruneSQLRefs(tx)
+		})
+	})
+	return copied, err
+}
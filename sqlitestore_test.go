@@ -0,0 +1,98 @@
+//
+// sqlitestore_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestSQLiteStore(t testing.TB) (*SQLiteStore, func()) {
+	dir, err := ioutil.TempDir("", "eventdb")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	s, err := OpenSQLiteStore(filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("open sqlite error: %s", err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteMigrateFromBolt(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	events := []*Event{
+		{Name: "deploy", Title: "e1", Time: int64(time.Second), Tags: []string{"t2", "t1"}},
+		{Title: "e2", Time: 2 * int64(time.Second), TimeEnd: 5 * int64(time.Second),
+			Text: "some text", DashboardUID: "d1", PanelID: 3},
+	}
+	if err := db.SaveEvents(events); err != nil {
+		t.Fatalf("save events error: %s", err)
+	}
+	alert := &Event{Name: "alerts", Title: "firing", Time: 3 * int64(time.Second)}
+	if _, err := db.UpsertEvent([]byte("fp1"), alert); err != nil {
+		t.Fatalf("upsert event error: %s", err)
+	}
+	if err := db.SaveEvent(&Event{Name: "empty", Time: 1}); err != nil {
+		t.Fatalf("save event error: %s", err)
+	}
+	if _, err := db.DeleteEvents(time.Unix(0, 0), time.Unix(0, 1), "empty"); err != nil {
+		t.Fatalf("delete events error: %s", err)
+	}
+
+	s, scleanup := openTestSQLiteStore(t)
+	defer scleanup()
+
+	copied, err := s.MigrateFromBolt(db)
+	if err != nil {
+		t.Fatalf("migrate error: %s", err)
+	}
+	if copied != 3 {
+		t.Errorf("expected 3 copied events, got %d", copied)
+	}
+
+	for _, e := range append(events, alert) {
+		se, err := s.GetEvent(e.ID)
+		if err != nil {
+			t.Errorf("get event %s error: %s", e.ID, err)
+		} else if !reflect.DeepEqual(se, e) {
+			t.Errorf("expected %+v, got %+v", e, se)
+		}
+	}
+
+	names, err := s.GetNames()
+	if err != nil {
+		t.Fatalf("get names error: %s", err)
+	}
+	if exp := []string{"__default__", "alerts", "deploy", "empty"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("expected names %v, got %v", exp, names)
+	}
+
+	// external references are copied
+	created, err := s.UpsertEvent([]byte("fp1"), &Event{Name: "alerts", Title: "resolved",
+		Time: 3 * int64(time.Second)})
+	if err != nil {
+		t.Fatalf("upsert event error: %s", err)
+	}
+	if created {
+		t.Errorf("expected existing event to be updated")
+	}
+	if e, err := s.GetEvent(alert.ID); err != nil || e.Title != "resolved" {
+		t.Errorf("expected updated event, got %+v, %v", e, err)
+	}
+}
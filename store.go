@@ -0,0 +1,148 @@
+//
+// store.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// EventStore is storage of events used by handlers
+type EventStore interface {
+	// SaveEvent store new event; assign id when empty
+	SaveEvent(e *Event) error
+	// SaveEvents store all `events` at once
+	SaveEvents(events []*Event) error
+	// GetEvent find event by `id`; return ErrEventNotFound when not exists
+	GetEvent(id string) (*Event, error)
+	// UpdateEvent find event by `id` and apply changes by `update` function
+	UpdateEvent(id string, update func(e *Event) error) (*Event, error)
+	// UpsertEvent save event `e` or replace event previously saved with the
+	// same external reference `ref`; return true when event was created
+	UpsertEvent(ref []byte, e *Event) (bool, error)
+	// DeleteEvent find and delete event by `id`
+	DeleteEvent(id string) error
+	// DeleteEvents delete events started in time range from bucket `name`
+	// (or AnyBucket)
+	DeleteEvents(from, to time.Time, name string) (int, error)
+
+	// IterEvents call `fn` for each event matching query `q`; return cursor
+	// for next page when number of events is limited
+	IterEvents(ctx context.Context, q Query, fn func(*Event) error) (string, error)
+	// GetEvents return events matching query `q`; see IterEvents
+	GetEvents(q Query) ([]*Event, string, error)
+	// GetHistogram count events in time bins
+	GetHistogram(q HistogramQuery) (*Histogram, error)
+	// GetNames return names of all buckets
+	GetNames() ([]string, error)
+	// GetTags return all tags used by events
+	GetTags() ([]string, error)
+
+	// ExportEvents write events matching `q` into `w` as JSON Lines
+	ExportEvents(ctx context.Context, w io.Writer, q Query) (int, error)
+	// ImportEvents read events in JSON Lines format and save events matching
+	// `q`; events with id of existing event replace it
+	ImportEvents(r io.Reader, q Query) (imported, skipped int, err error)
+
+	// Vacuum remove events older than retention time and drop empty buckets
+	Vacuum(c *Configuration, now time.Time, dryRun bool) (*VacuumResult, error)
+
+	Close() error
+}
+
+var (
+	_ EventStore = (*DB)(nil)
+	_ EventStore = (*MemStore)(nil)
+	_ EventStore = (*SQLiteStore)(nil)
+)
+
+// OpenStore create events storage configured in `c`
+func OpenStore(c *Configuration) (EventStore, error) {
+	switch c.Storage {
+	case "memory":
+		return NewMemStore(), nil
+	case "sqlite":
+		s, err := OpenSQLiteStore(c.SQLiteFile)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "", "bolt":
+		db, err := DBOpen(c.DBFile)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown storage '%s'", c.Storage)
+}
+
+// compactor is implemented by stores that can reclaim unused space
+type compactor interface {
+	Compact() (*CompactResult, error)
+	FreePageRatio() float64
+}
+
+// iterQuery call `fn` for each event returned by `it` matching query `q`.
+// Return cursor for next page when number of events is limited by q.Limit
+// and there are more events.
+func iterQuery(ctx context.Context, it locationIterator, q *Query, qf *queryFilter,
+	fn func(*Event) error) (string, error) {
+
+	next := func() (*eventLocation, *Event, error) {
+		for loc, v := it.next(); loc != nil; loc, v = it.next() {
+			e := &Event{}
+			if err := e.unmarshal(v); err != nil {
+				log.Errorf("ERROR: decode event %v in %s error: %s", loc.key, loc.bname, err)
+				continue
+			}
+			return loc, e, nil
+		}
+		return nil, nil, nil
+	}
+	return iterQueryEvents(ctx, next, q, qf, fn)
+}
+
+// iterQueryEvents work like iterQuery for already decoded events; `next`
+// return nil location when there is no more events.
+func iterQueryEvents(ctx context.Context, next func() (*eventLocation, *Event, error),
+	q *Query, qf *queryFilter, fn func(*Event) error) (string, error) {
+
+	cnt := 0
+	var last *eventLocation
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		loc, e, err := next()
+		if err != nil {
+			return "", err
+		}
+		if loc == nil {
+			return "", nil
+		}
+		if !qf.match(e) {
+			continue
+		}
+		if q.Limit > 0 && cnt == q.Limit {
+			return encodeCursor(last), nil
+		}
+		if err := fn(e); err != nil {
+			if err == ErrStopIteration {
+				err = nil
+			}
+			return "", err
+		}
+		cnt++
+		last = loc
+	}
+}
@@ -0,0 +1,63 @@
+//
+// store_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+// testStores create all EventStore implementations for tests; return store
+// and cleanup function
+var testStores = []struct {
+	name string
+	open func(t testing.TB) (EventStore, func())
+}{
+	{"bolt", func(t testing.TB) (EventStore, func()) {
+		return openTestDB(t)
+	}},
+	{"sqlite", func(t testing.TB) (EventStore, func()) {
+		return openTestSQLiteStore(t)
+	}},
+	{"memory", func(t testing.TB) (EventStore, func()) {
+		return NewMemStore(), func() {}
+	}},
+}
+
+// storeTests check behaviour common for all EventStore implementations
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, db EventStore)
+}{
+	{"EventByID", testEventByID},
+	{"GetEventsOverlap", testGetEventsOverlap},
+	{"UpsertEvent", testUpsertEvent},
+	{"GetEventsByTags", testGetEventsByTags},
+	{"GetEventsByText", testGetEventsByText},
+	{"GetEventsPages", testGetEventsPages},
+	{"IterEvents", testIterEvents},
+	{"GetHistogram", testGetHistogram},
+	{"GetNamesTags", testGetNamesTags},
+	{"BucketSpan", testBucketSpan},
+	{"SameTimeEvents", testSameTimeEvents},
+	{"SaveEventsAtomic", testSaveEventsAtomic},
+	{"ExportImport", testExportImport},
+	{"Vacuum", testVacuum},
+	{"VacuumDryRunDropBuckets", testVacuumDryRunDropBuckets},
+}
+
+func TestEventStores(t *testing.T) {
+	for _, s := range testStores {
+		for _, st := range storeTests {
+			t.Run(s.name+"/"+st.name, func(t *testing.T) {
+				db, cleanup := s.open(t)
+				defer cleanup()
+				st.test(t, db)
+			})
+		}
+	}
+}
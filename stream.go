@@ -0,0 +1,139 @@
+//
+// stream.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// streamWriteTimeout limit time of each write of streamed response, so
+// stalled client don't hold database forever
+const streamWriteTimeout = 30 * time.Second
+
+// responseStreamer may be returned by handlers instead of data; it write
+// response body directly into client connection.
+type responseStreamer func(w io.Writer) error
+
+// csvStreamer may be returned by handlers to write response as CSV
+type csvStreamer func(w *csv.Writer) error
+
+// jsonArrayWriter write values into `w` as JSON array, one by one
+type jsonArrayWriter struct {
+	w     io.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONArrayWriter(w io.Writer) *jsonArrayWriter {
+	return &jsonArrayWriter{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Write append value `v` to array
+func (j *jsonArrayWriter) Write(v interface{}) error {
+	sep := []byte{','}
+	if j.count == 0 {
+		sep[0] = '['
+	}
+	if _, err := j.w.Write(sep); err != nil {
+		return err
+	}
+	j.count++
+	return j.enc.Encode(v)
+}
+
+// Close finish array
+func (j *jsonArrayWriter) Close() error {
+	if j.count == 0 {
+		_, err := j.w.Write([]byte("[]\n"))
+		return err
+	}
+	_, err := j.w.Write([]byte("]\n"))
+	return err
+}
+
+// deadlineWriter extend write deadline of response before each write
+type deadlineWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func newDeadlineWriter(w http.ResponseWriter) *deadlineWriter {
+	return &deadlineWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	// error is ignored when writer don't support deadlines
+	d.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return d.w.Write(p)
+}
+
+// Close flush buffered data and clear deadline so it don't affect next
+// requests on the same connection
+func (d *deadlineWriter) Close() error {
+	d.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	err := d.rc.Flush()
+	if err == http.ErrNotSupported {
+		err = nil
+	}
+	d.rc.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// streamEvents write events returned by `iter` as JSON array
+func streamEvents(w io.Writer, iter func(fn func(*Event) error) error) error {
+	aw := newJSONArrayWriter(w)
+	if err := iter(func(e *Event) error {
+		return aw.Write(e)
+	}); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// writeResponse encode `data` into response as json; responseStreamer and
+// csvStreamer write response by itself, with deadline for each write.
+func writeResponse(w http.ResponseWriter, data interface{}, l log.Logger) {
+	switch v := data.(type) {
+	case nil:
+	case responseStreamer:
+		dw := newDeadlineWriter(w)
+		err := v(dw)
+		if cerr := dw.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			l.Errorf("streaming result error: %s", err)
+		}
+	case csvStreamer:
+		dw := newDeadlineWriter(w)
+		cw := csv.NewWriter(dw)
+		err := v(cw)
+		if cw.Flush(); err == nil {
+			err = cw.Error()
+		}
+		if cerr := dw.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			l.Errorf("streaming csv result error: %s", err)
+		}
+	default:
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			l.Errorf("encoding result error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+//
+// tagexpr.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type (
+	// TagExpr is boolean expression on event tags, ie.
+	// `deploy AND (prod OR staging) AND NOT canary`.
+	TagExpr interface {
+		// Match check if `tags` fulfill expression
+		Match(tags []string) bool
+		String() string
+	}
+
+	tagTerm string
+	tagAnd  []TagExpr
+	tagOr   []TagExpr
+	tagNot  struct {
+		expr TagExpr
+	}
+)
+
+func (t tagTerm) Match(tags []string) bool {
+	for _, tag := range tags {
+		if tag == string(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t tagTerm) String() string {
+	return string(t)
+}
+
+func (a tagAnd) Match(tags []string) bool {
+	for _, e := range a {
+		if !e.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a tagAnd) String() string {
+	return joinTagExpr([]TagExpr(a), " AND ")
+}
+
+func (o tagOr) Match(tags []string) bool {
+	for _, e := range o {
+		if e.Match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o tagOr) String() string {
+	return joinTagExpr([]TagExpr(o), " OR ")
+}
+
+func (n tagNot) Match(tags []string) bool {
+	return !n.expr.Match(tags)
+}
+
+func (n tagNot) String() string {
+	return "NOT " + subTagExprString(n.expr)
+}
+
+func subTagExprString(e TagExpr) string {
+	switch e.(type) {
+	case tagAnd, tagOr:
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func joinTagExpr(exprs []TagExpr, sep string) string {
+	parts := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		parts = append(parts, subTagExprString(e))
+	}
+	return strings.Join(parts, sep)
+}
+
+// indexTags return list of tags that at least one must exist in event matching
+// expression `e`. Return nil when expression can't be resolved by tag index.
+func indexTags(e TagExpr) []string {
+	switch v := e.(type) {
+	case tagTerm:
+		return []string{string(v)}
+	case tagAnd:
+		// the shortest list from any operand
+		var res []string
+		for _, se := range v {
+			if tags := indexTags(se); tags != nil && (res == nil || len(tags) < len(res)) {
+				res = tags
+			}
+		}
+		return res
+	case tagOr:
+		// all operands must be resolvable by index
+		var res []string
+		for _, se := range v {
+			tags := indexTags(se)
+			if tags == nil {
+				return nil
+			}
+			res = append(res, tags...)
+		}
+		return res
+	}
+	return nil
+}
+
+// requiredTags return list of tags when expression `e` only require all
+// of them (like old `name:tag1:tag2` query); otherwise return nil
+func requiredTags(e TagExpr) []string {
+	switch v := e.(type) {
+	case tagTerm:
+		return []string{string(v)}
+	case tagAnd:
+		var res []string
+		for _, se := range v {
+			tags := requiredTags(se)
+			if tags == nil {
+				return nil
+			}
+			res = append(res, tags...)
+		}
+		return res
+	}
+	return nil
+}
+
+type tagExprToken struct {
+	value string
+	pos   int
+}
+
+type tagExprParser struct {
+	tokens []tagExprToken
+	pos    int
+	end    int
+}
+
+func tokenizeTagExpr(s string) []tagExprToken {
+	var tokens []tagExprToken
+	start := -1
+	for i, r := range s {
+		if r == '(' || r == ')' || r == ',' || unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = append(tokens, tagExprToken{s[start:i], start + 1})
+				start = -1
+			}
+			if r == '(' || r == ')' {
+				tokens = append(tokens, tagExprToken{string(r), i + 1})
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, tagExprToken{s[start:], start + 1})
+	}
+	return tokens
+}
+
+func isTagExprOperator(t string) bool {
+	switch strings.ToUpper(t) {
+	case "AND", "OR", "NOT":
+		return true
+	}
+	return false
+}
+
+// ParseTagExpr parse tag query expression. Supported operators (case
+// insensitive): AND, OR, NOT and parentheses. Tags separated only by spaces or
+// commas are joined by AND. Return nil expression for empty query.
+func ParseTagExpr(s string) (TagExpr, error) {
+	p := &tagExprParser{
+		tokens: tokenizeTagExpr(s),
+		end:    len(s) + 1,
+	}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.value, t.pos)
+	}
+	return e, nil
+}
+
+func (p *tagExprParser) peek() *tagExprToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *tagExprParser) isNext(op string) bool {
+	t := p.peek()
+	return t != nil && strings.ToUpper(t.value) == op
+}
+
+func (p *tagExprParser) parseOr() (TagExpr, error) {
+	e, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	res := tagOr{e}
+	for p.isNext("OR") {
+		p.pos++
+		e, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (p *tagExprParser) parseAnd() (TagExpr, error) {
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	res := tagAnd{e}
+	for {
+		t := p.peek()
+		if t == nil || t.value == ")" || p.isNext("OR") {
+			break
+		}
+		if p.isNext("AND") {
+			p.pos++
+		}
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	if len(res) == 1 {
+		return res[0], nil
+	}
+	return res, nil
+}
+
+func (p *tagExprParser) parseUnary() (TagExpr, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression at position %d", p.end)
+	}
+	p.pos++
+
+	switch {
+	case strings.ToUpper(t.value) == "NOT":
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return tagNot{e}, nil
+	case t.value == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if cl := p.peek(); cl == nil || cl.value != ")" {
+			return nil, fmt.Errorf("missing ')' for '(' at position %d", t.pos)
+		}
+		p.pos++
+		return e, nil
+	case t.value == ")" || isTagExprOperator(t.value):
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.value, t.pos)
+	}
+
+	return tagTerm(t.value), nil
+}
+
+// parseTagQuery parse all non-empty `queries` and join them by AND
+func parseTagQuery(queries ...string) (TagExpr, error) {
+	var exprs tagAnd
+	for _, q := range queries {
+		e, err := ParseTagExpr(q)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			exprs = append(exprs, e)
+		}
+	}
+	switch len(exprs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
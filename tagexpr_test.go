@@ -0,0 +1,128 @@
+//
+// tagexpr_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tests := []struct {
+		query string
+		str   string
+		tags  []string
+	}{
+		{"", "", nil},
+		{"t1", "t1", []string{"t1"}},
+		{"t1 t2", "t1 AND t2", []string{"t1"}},
+		{"t1,t2", "t1 AND t2", []string{"t1"}},
+		{"t1 and t2", "t1 AND t2", []string{"t1"}},
+		{"t1 OR t2 t3", "t1 OR (t2 AND t3)", []string{"t1", "t2"}},
+		{"NOT t1", "NOT t1", nil},
+		{"t1 AND NOT t2", "t1 AND NOT t2", []string{"t1"}},
+		{"deploy AND (prod OR staging) AND NOT canary",
+			"deploy AND (prod OR staging) AND NOT canary", []string{"deploy"}},
+		{"(prod OR staging) deploy", "(prod OR staging) AND deploy", []string{"deploy"}},
+		{"((t1))", "t1", []string{"t1"}},
+		{"t1 OR NOT t2", "t1 OR NOT t2", nil},
+	}
+
+	for _, tc := range tests {
+		e, err := ParseTagExpr(tc.query)
+		if err != nil {
+			t.Errorf("parse %q error: %s", tc.query, err)
+			continue
+		}
+		if e == nil {
+			if tc.str != "" {
+				t.Errorf("parse %q: missing expression", tc.query)
+			}
+			continue
+		}
+		if s := e.String(); s != tc.str {
+			t.Errorf("parse %q: invalid result: %q, expected %q", tc.query, s, tc.str)
+		}
+		if tags := indexTags(e); !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("parse %q: invalid index tags: %v, expected %v", tc.query, tags, tc.tags)
+		}
+	}
+}
+
+func TestRequiredTags(t *testing.T) {
+	tests := []struct {
+		queries []string
+		tags    []string
+	}{
+		{[]string{"t1"}, []string{"t1"}},
+		{[]string{"t1 t2", "t3"}, []string{"t1", "t2", "t3"}},
+		{[]string{"t1 AND (t2 t3)"}, []string{"t1", "t2", "t3"}},
+		{[]string{"t1 OR t2"}, nil},
+		{[]string{"t1", "NOT t2"}, nil},
+	}
+
+	for _, tc := range tests {
+		e, err := parseTagQuery(tc.queries...)
+		if err != nil {
+			t.Errorf("parse %q error: %s", tc.queries, err)
+			continue
+		}
+		if tags := requiredTags(e); !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("parse %q: invalid required tags: %v, expected %v", tc.queries, tags, tc.tags)
+		}
+	}
+}
+
+func TestParseTagExprErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"t1 AND", "unexpected end of expression at position 7"},
+		{"OR t1", "unexpected 'OR' at position 1"},
+		{"(t1 OR t2", "missing ')' for '(' at position 1"},
+		{"t1 OR t2)", "unexpected ')' at position 9"},
+		{"t1 AND OR t2", "unexpected 'OR' at position 8"},
+		{"()", "unexpected ')' at position 2"},
+		{"NOT", "unexpected end of expression at position 4"},
+	}
+
+	for _, tc := range tests {
+		_, err := ParseTagExpr(tc.query)
+		if err == nil {
+			t.Errorf("parse %q: missing error", tc.query)
+		} else if err.Error() != tc.err {
+			t.Errorf("parse %q: invalid error: %q, expected %q", tc.query, err, tc.err)
+		}
+	}
+}
+
+func TestTagExprMatch(t *testing.T) {
+	e, err := ParseTagExpr("deploy AND (prod OR staging) AND NOT canary")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+
+	tests := []struct {
+		tags  []string
+		match bool
+	}{
+		{nil, false},
+		{[]string{"deploy"}, false},
+		{[]string{"deploy", "prod"}, true},
+		{[]string{"staging", "deploy"}, true},
+		{[]string{"deploy", "prod", "canary"}, false},
+		{[]string{"prod", "staging"}, false},
+	}
+
+	for _, tc := range tests {
+		if m := e.Match(tc.tags); m != tc.match {
+			t.Errorf("match %v: %v, expected %v", tc.tags, m, tc.match)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+//
+// vacuum.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	vacuumDeleted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "eventdb_vacuum_events_deleted_total",
+			Help: "Total number events deleted by vacuum worker",
+		},
+	)
+	vacuumLastRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "eventdb_vacuum_last_run_time_seconds",
+			Help: "Last run of vacuum routine.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(vacuumDeleted)
+	prometheus.MustRegister(vacuumLastRun)
+}
+
+// vacuum delete expired events according to configuration `c`
+func vacuum(c *Configuration, db EventStore, dryRun bool) (*VacuumResult, error) {
+	res, err := db.Vacuum(c, time.Now(), dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		vacuumDeleted.Add(float64(res.Total()))
+		vacuumLastRun.SetToCurrentTime()
+	}
+	return res, nil
+}
+
+type vacuumWorker struct {
+	Configuration *Configuration
+	DB            EventStore
+
+	reload chan *Configuration
+}
+
+// Start vacuum worker; first vacuum is run after one minute, next every
+// configured interval. Reload don't postpone vacuum: next run is scheduled
+// after new interval counted from last run.
+func (v *vacuumWorker) Start() {
+	v.reload = make(chan *Configuration, 1)
+	c := v.Configuration
+
+	go func() {
+		next := time.Now().Add(1 * time.Minute)
+		var lastRun time.Time
+		timer := time.NewTimer(time.Until(next))
+		for {
+			select {
+			case newConf := <-v.reload:
+				c = newConf
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			case <-timer.C:
+				lastRun = time.Now()
+				if c.RetentionParsed != nil || len(c.RetentionRules) > 0 {
+					if res, err := vacuum(c, v.DB, false); err == nil {
+						log.Infof("vacuum deleted %d events, dropped buckets: %v", res.Total(), res.Dropped)
+					} else {
+						log.Errorf("vacuum delete error: %s", err.Error())
+					}
+				}
+				if c.CompactThreshold > 0 {
+					v.compact(c.CompactThreshold)
+				}
+			}
+			next = nextVacuum(next, lastRun, c.VacuumIntervalParsed)
+			timer.Reset(time.Until(next))
+		}
+	}()
+}
+
+// nextVacuum return time of next vacuum run: `interval` after `lastRun` or,
+// when vacuum was not run yet, previously scheduled `next`
+func nextVacuum(next, lastRun time.Time, interval time.Duration) time.Time {
+	if lastRun.IsZero() {
+		return next
+	}
+	return lastRun.Add(interval)
+}
+
+// compact database when ratio of free pages exceed `threshold`; only stores
+// that support compaction are compacted
+func (v *vacuumWorker) compact(threshold float64) {
+	cs, ok := v.DB.(compactor)
+	if !ok {
+		return
+	}
+	ratio := cs.FreePageRatio()
+	if ratio < threshold {
+		return
+	}
+	log.Infof("free pages ratio %0.2f exceeded threshold; starting compaction", ratio)
+	if res, err := cs.Compact(); err == nil {
+		log.Infof("compaction finished; size %d -> %d", res.SizeBefore, res.SizeAfter)
+	} else {
+		log.Errorf("compact error: %s", err.Error())
+	}
+}
+
+// Reload configuration; next vacuum is scheduled after new interval from
+// last run (or immediately when it already passed)
+func (v *vacuumWorker) Reload(c *Configuration) {
+	v.Configuration = c
+	// drop not handled configuration
+	select {
+	case <-v.reload:
+	default:
+	}
+	v.reload <- c
+}
+
+// vacuumHandler run vacuum on request; require admin token
+type vacuumHandler struct {
+	Configuration *Configuration
+	DB            EventStore
+}
+
+func (h *vacuumHandler) onPost(w http.ResponseWriter, r *http.Request, l log.Logger) (int, interface{}) {
+	l = l.With("action", "vacuumHandler.onPost")
+
+	if status := h.Configuration.authorizeAdmin(r); status != http.StatusOK {
+		l.Infof("vacuum unauthorized")
+		return status, http.StatusText(status)
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dryrun"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return http.StatusBadRequest, "wrong dryrun"
+		}
+	}
+
+	res, err := vacuum(h.Configuration, h.DB, dryRun)
+	if err != nil {
+		l.Errorf("vacuum error: %s", err.Error())
+		return http.StatusInternalServerError, "error"
+	}
+	l.Infof("vacuum (dry run: %v) deleted %d events, dropped buckets: %v", dryRun, res.Total(), res.Dropped)
+	return http.StatusOK, res
+}
+
+func (h vacuumHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := log.With("remote", r.RemoteAddr).With("req", r.RequestURI)
+
+	code := http.StatusNotFound
+	var data interface{}
+
+	switch r.Method {
+	case "POST":
+		code, data = h.onPost(w, r, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	writeResponse(w, data, l)
+}
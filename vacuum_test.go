@@ -0,0 +1,48 @@
+//
+// vacuum_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextVacuum(t *testing.T) {
+	start := time.Date(2017, 6, 14, 12, 0, 0, 0, time.UTC)
+	first := start.Add(time.Minute)
+	lastRun := start.Add(2 * time.Hour)
+
+	tests := []struct {
+		next     time.Time
+		lastRun  time.Time
+		interval time.Duration
+		expected time.Time
+	}{
+		// reload before first run keep first run
+		{first, time.Time{}, time.Hour, first},
+		// after run and on reload vacuum is scheduled from last run
+		{lastRun, lastRun, time.Hour, lastRun.Add(time.Hour)},
+		{lastRun.Add(time.Hour), lastRun, 6 * time.Hour, lastRun.Add(6 * time.Hour)},
+		{lastRun.Add(6 * time.Hour), lastRun, 30 * time.Minute, lastRun.Add(30 * time.Minute)},
+	}
+
+	for i, tc := range tests {
+		if res := nextVacuum(tc.next, tc.lastRun, tc.interval); !res.Equal(tc.expected) {
+			t.Errorf("%d: expected %v, got %v", i, tc.expected, res)
+		}
+	}
+
+	// frequent reloads don't postpone vacuum
+	next := nextVacuum(first, lastRun, time.Hour)
+	for i := 0; i < 10; i++ {
+		next = nextVacuum(next, lastRun, time.Hour)
+	}
+	if !next.Equal(lastRun.Add(time.Hour)) {
+		t.Errorf("vacuum postponed by reloads to %v", next)
+	}
+}
@@ -0,0 +1,179 @@
+//
+// writer.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// maxWriteBatch is max number of writes committed in one transaction
+const maxWriteBatch = 1000
+
+// ErrDBClosed when writing to closed database
+var ErrDBClosed = errors.New("database closed")
+
+var (
+	writeBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "eventdb_write_batch_size",
+			Help:    "Number of writes committed in one transaction",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		},
+	)
+	writeQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "eventdb_write_queue_wait_seconds",
+			Help:    "Time spent by writes waiting for transaction",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(writeBatchSize)
+	prometheus.MustRegister(writeQueueWait)
+}
+
+type (
+	writeReq struct {
+		fn     func(tx *bolt.Tx) error
+		queued time.Time
+		err    chan error
+	}
+
+	// batchWriter coalesce concurrent writes into one transaction. Writes
+	// queued while previous transaction is committed are committed together,
+	// so latency is bounded by time of one commit.
+	batchWriter struct {
+		db    *bolt.DB
+		queue chan *writeReq
+		done  chan struct{}
+
+		mu     sync.RWMutex
+		closed bool
+	}
+)
+
+func newBatchWriter(db *bolt.DB) *batchWriter {
+	w := &batchWriter{
+		db:    db,
+		queue: make(chan *writeReq, maxWriteBatch),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// update run `fn` in write transaction, probably shared with other writes.
+// `fn` may be called more than once (when other write in transaction fail),
+// so it must be idempotent.
+func (w *batchWriter) update(fn func(tx *bolt.Tx) error) error {
+	req := &writeReq{
+		fn:     fn,
+		queued: time.Now(),
+		err:    make(chan error, 1),
+	}
+
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return ErrDBClosed
+	}
+	w.queue <- req
+	w.mu.RUnlock()
+
+	return <-req.err
+}
+
+// close stop writer after committing all queued writes
+func (w *batchWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *batchWriter) run() {
+	defer close(w.done)
+
+	batch := make([]*writeReq, 0, maxWriteBatch)
+	for req := range w.queue {
+		batch = append(batch[:0], req)
+	collect:
+		for len(batch) < maxWriteBatch {
+			select {
+			case req, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		w.commit(batch)
+	}
+}
+
+func (w *batchWriter) commit(batch []*writeReq) {
+	now := time.Now()
+	for _, req := range batch {
+		writeQueueWait.Observe(now.Sub(req.queued).Seconds())
+	}
+	writeBatchSize.Observe(float64(len(batch)))
+
+	failed := -1
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		for i, req := range batch {
+			if err := req.call(tx); err != nil {
+				failed = i
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err == nil || failed < 0 {
+		// success or commit error
+		for _, req := range batch {
+			req.err <- err
+		}
+		return
+	}
+
+	// one write failed or panicked; rollback other writes and retry them
+	// separately
+	batch[failed].err <- err
+	for i, req := range batch {
+		if i != failed {
+			req.err <- w.db.Update(req.call)
+		}
+	}
+}
+
+// call write function; panic is returned as error, so it don't stop writer
+// and other writes in batch are retried
+func (req *writeReq) call(tx *bolt.Tx) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("write panic: %v", r)
+			err = fmt.Errorf("write panic: %v", r)
+		}
+	}()
+	return req.fn(tx)
+}
@@ -0,0 +1,155 @@
+//
+// writer_test.go
+// Copyright (C) 2017 Karol Będkowski
+//
+// Distributed under terms of the GPLv3 license.
+//
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBatchWriterConcurrent(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	ids := make([]string, 200)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e := &Event{Name: "b" + strconv.Itoa(i%5), Title: strconv.Itoa(i), Time: int64(i+1) * 1000000000}
+			if err := db.SaveEvent(e); err != nil {
+				t.Errorf("save event error: %s", err)
+			}
+			ids[i] = e.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for i, id := range ids {
+		e, err := db.GetEvent(id)
+		if err != nil || e.Title != strconv.Itoa(i) {
+			t.Fatalf("invalid event %d: %+v, %v", i, e, err)
+		}
+	}
+}
+
+// testBatchWriterFailure commit batch of writes where third write is `failing`
+// and check other writes are saved; return error of failed write
+func testBatchWriterFailure(t *testing.T, db *DB, failing func(tx *bolt.Tx) error) error {
+	var batch []*writeReq
+	var events []*Event
+	for i := 0; i < 5; i++ {
+		e := &Event{Title: strconv.Itoa(i), Time: int64(i+1) * 1000000000}
+		events = append(events, e)
+		fn := func(tx *bolt.Tx) error {
+			return putEvent(tx, e)
+		}
+		if i == 2 {
+			fn = failing
+		}
+		batch = append(batch, &writeReq{fn: fn, queued: time.Now(), err: make(chan error, 1)})
+	}
+
+	db.writer.commit(batch)
+
+	var failedErr error
+	for i, req := range batch {
+		err := <-req.err
+		if i == 2 {
+			failedErr = err
+			continue
+		}
+		if err != nil {
+			t.Errorf("write %d error: %s", i, err)
+		}
+		if e, err := db.GetEvent(events[i].ID); err != nil || e.Title != events[i].Title {
+			t.Errorf("invalid event %d: %+v, %v", i, e, err)
+		}
+	}
+	return failedErr
+}
+
+func TestBatchWriterFailure(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	errTest := errors.New("test")
+	err := testBatchWriterFailure(t, db, func(tx *bolt.Tx) error {
+		return errTest
+	})
+	if err != errTest {
+		t.Errorf("invalid error for failed write: %v", err)
+	}
+
+	db.Close()
+	if err := db.SaveEvent(&Event{Time: 1}); err != ErrDBClosed {
+		t.Errorf("invalid error for closed db: %v", err)
+	}
+}
+
+func TestBatchWriterPanic(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	err := testBatchWriterFailure(t, db, func(tx *bolt.Tx) error {
+		panic("test")
+	})
+	if err == nil || err.Error() != "write panic: test" {
+		t.Errorf("invalid error for panicked write: %v", err)
+	}
+
+	// writer still works
+	if err := db.SaveEvent(&Event{Title: "after", Time: 1}); err != nil {
+		t.Errorf("save event after panic error: %s", err)
+	}
+}
+
+func benchmarkSaveEvent(b *testing.B, save func(db *DB, e *Event) error) {
+	db, cleanup := openTestDB(b)
+	defer cleanup()
+
+	var cnt int64
+	var mu sync.Mutex
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			cnt++
+			ts := cnt
+			mu.Unlock()
+			e := &Event{Name: "bench", Title: "title", Time: ts * 1000000000, Tags: []string{"t1", "t2"}}
+			if err := save(db, e); err != nil {
+				b.Fatalf("save event error: %s", err)
+			}
+		}
+	})
+}
+
+// BenchmarkSaveEvent save events by concurrent writers through batch writer
+func BenchmarkSaveEvent(b *testing.B) {
+	benchmarkSaveEvent(b, func(db *DB, e *Event) error {
+		return db.SaveEvent(e)
+	})
+}
+
+// BenchmarkSaveEventSingleTx save events by concurrent writers, each in own
+// transaction
+func BenchmarkSaveEventSingleTx(b *testing.B) {
+	benchmarkSaveEvent(b, func(db *DB, e *Event) error {
+		return db.db.Update(func(tx *bolt.Tx) error {
+			return putEvent(tx, e)
+		})
+	})
+}